@@ -3,6 +3,8 @@ package servian
 import (
 	"context"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
@@ -31,8 +33,18 @@ func Backend(k KubernetesInterface) *backend {
 		Help: strings.TrimSpace(backendHelp),
 		Paths: []*framework.Path{
 			configurePlugin(&b),
+			rotateRoot(&b),
+			listRoles(&b),
+			configureRole(&b),
+			listClusters(&b),
+			configureCluster(&b),
+			rotateClusterRoot(&b),
 			invalidPath(&b),
 			readSecret(&b),
+			readClusterSecret(&b),
+			readClusterWideSecret(&b),
+			readClusterWideClusterSecret(&b),
+			tidy(&b),
 		},
 		Secrets: []*framework.Secret{
 			secret(&b),
@@ -40,16 +52,58 @@ func Backend(k KubernetesInterface) *backend {
 		PathsSpecial: &logical.Paths{
 			SealWrapStorage: []string{
 				configPath,
+				clustersPath,
+			},
+
+			// the write-ahead log and the lease index are written when credentials are issued, which performance
+			// secondaries also do, and only describe the objects created by the node that wrote them
+			LocalStorage: []string{
+				framework.WALPrefix,
+				leasesPath,
 			},
 		},
 
-		BackendType: logical.TypeLogical,
+		Invalidate:        b.invalidate,
+		PeriodicFunc:      b.periodicFunc,
+		WALRollback:       b.walRollback,
+		WALRollbackMinAge: walRollbackMinAge,
+		BackendType:       logical.TypeLogical,
 	}
 	b.kubernetesService = k
+	b.lastTidy = map[string]time.Time{}
+	b.namespaceCache = newTTLCache(namespaceCacheTTL)
+	b.clusterRoleCache = newTTLCache(clusterRoleCacheTTL)
 	return &b
 }
 
 type backend struct {
 	*framework.Backend
 	kubernetesService KubernetesInterface
+	rotateLock        sync.Mutex
+	tidyLock          sync.Mutex
+
+	// lastTidy records when each cluster was last tidied by the periodic function
+	lastTidy map[string]time.Time
+
+	// namespaceCache keeps the labels of the namespaces fetched to match namespace selectors for a short time
+	namespaceCache *ttlCache
+
+	// clusterRoleCache keeps the ClusterRoles bound by roles that were found, so they are not fetched for every request
+	clusterRoleCache *ttlCache
+}
+
+// invalidate removes the cached Kubernetes clients when the connection settings change, which includes changes written
+// by other nodes of the vault cluster
+func (b *backend) invalidate(ctx context.Context, key string) {
+	if key == configPath || strings.HasPrefix(key, clustersPath) {
+		b.kubernetesService.ResetClients()
+	}
+}
+
+// periodicFunc runs the scheduled maintenance of the plugin
+func (b *backend) periodicFunc(ctx context.Context, req *logical.Request) error {
+	if err := b.rotateRootTokens(ctx, req.Storage); err != nil {
+		return err
+	}
+	return b.tidyClusters(ctx, req.Storage, req.MountAccessor)
 }
@@ -0,0 +1,312 @@
+package servian
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/logical"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// fakeKubernetesService records the objects the backend creates instead of calling a Kubernetes API
+type fakeKubernetesService struct {
+	lock            sync.Mutex
+	serviceAccounts []*ServiceAccountDetails
+	roleBindings    []*RoleBindingDetails
+}
+
+func (f *fakeKubernetesService) CreateServiceAccount(ctx context.Context, pluginConfig *PluginConfig, namespace string, serviceAccountName string, metadata *ObjectMetadata) (*ServiceAccountDetails, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	sa := &ServiceAccountDetails{Namespace: namespace, Name: serviceAccountName, CreatedAt: time.Now()}
+	f.serviceAccounts = append(f.serviceAccounts, sa)
+	return sa, nil
+}
+
+func (f *fakeKubernetesService) GetServiceAccountSecret(ctx context.Context, pluginConfig *PluginConfig, sa *ServiceAccountDetails) (*ServiceAccountSecret, error) {
+	return &ServiceAccountSecret{CACert: pluginConfig.CACert, Namespace: sa.Namespace, Token: "legacy-token"}, nil
+}
+
+func (f *fakeKubernetesService) CreateServiceAccountToken(ctx context.Context, pluginConfig *PluginConfig, sa *ServiceAccountDetails, ttl int) (*ServiceAccountSecret, error) {
+	return &ServiceAccountSecret{CACert: pluginConfig.CACert, Namespace: sa.Namespace, Token: "bound-token", ExpiresAt: time.Now().Add(time.Duration(ttl) * time.Second)}, nil
+}
+
+func (f *fakeKubernetesService) GetServiceAccount(ctx context.Context, pluginConfig *PluginConfig, namespace string, serviceAccountName string) (*ServiceAccountDetails, error) {
+	return &ServiceAccountDetails{Namespace: namespace, Name: serviceAccountName}, nil
+}
+
+func (f *fakeKubernetesService) DeleteServiceAccount(ctx context.Context, pluginConfig *PluginConfig, namespace string, serviceAccountName string) error {
+	return nil
+}
+
+func (f *fakeKubernetesService) ListServiceAccounts(ctx context.Context, pluginConfig *PluginConfig, prefix string, labelSelector string) ([]*ServiceAccountDetails, error) {
+	return nil, nil
+}
+
+func (f *fakeKubernetesService) GetNamespace(ctx context.Context, pluginConfig *PluginConfig, namespace string) (*NamespaceDetails, error) {
+	return &NamespaceDetails{Name: namespace}, nil
+}
+
+func (f *fakeKubernetesService) DeleteSecret(ctx context.Context, pluginConfig *PluginConfig, namespace string, secretName string) error {
+	return nil
+}
+
+func (f *fakeKubernetesService) CreateRole(ctx context.Context, pluginConfig *PluginConfig, namespace string, roleName string, rules string, metadata *ObjectMetadata) (*RoleDetails, error) {
+	return &RoleDetails{Namespace: namespace, Name: roleName}, nil
+}
+
+func (f *fakeKubernetesService) DeleteRole(ctx context.Context, pluginConfig *PluginConfig, namespace string, roleName string) error {
+	return nil
+}
+
+func (f *fakeKubernetesService) ListRoles(ctx context.Context, pluginConfig *PluginConfig, prefix string, labelSelector string) ([]*RoleDetails, error) {
+	return nil, nil
+}
+
+func (f *fakeKubernetesService) GetClusterRole(ctx context.Context, pluginConfig *PluginConfig, clusterRoleName string) (*RoleDetails, error) {
+	if clusterRoleName == "missing" {
+		return nil, apierrors.NewNotFound(schema.GroupResource{Group: rbacGroup, Resource: "clusterroles"}, clusterRoleName)
+	}
+	return &RoleDetails{Name: clusterRoleName}, nil
+}
+
+func (f *fakeKubernetesService) CreateRoleBinding(ctx context.Context, pluginConfig *PluginConfig, namespace string, roleBindingName string, serviceAccountNamespace string, serviceAccountName string, roleKind string, roleName string, metadata *ObjectMetadata) (*RoleBindingDetails, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	rb := &RoleBindingDetails{
+		Namespace:               namespace,
+		Name:                    roleBindingName,
+		ServiceAccountNamespace: serviceAccountNamespace,
+		ServiceAccountName:      serviceAccountName,
+		RoleKind:                roleKind,
+		RoleName:                roleName,
+	}
+	f.roleBindings = append(f.roleBindings, rb)
+	return rb, nil
+}
+
+func (f *fakeKubernetesService) DeleteRoleBinding(ctx context.Context, pluginConfig *PluginConfig, namespace string, roleBindingName string) error {
+	return nil
+}
+
+func (f *fakeKubernetesService) ListRoleBindings(ctx context.Context, pluginConfig *PluginConfig, prefix string, labelSelector string) ([]*RoleBindingDetails, error) {
+	return nil, nil
+}
+
+func (f *fakeKubernetesService) CreateClusterRoleBinding(ctx context.Context, pluginConfig *PluginConfig, clusterRoleBindingName string, namespace string, serviceAccountName string, clusterRoleName string, metadata *ObjectMetadata) (*RoleBindingDetails, error) {
+	return &RoleBindingDetails{Name: clusterRoleBindingName}, nil
+}
+
+func (f *fakeKubernetesService) DeleteClusterRoleBinding(ctx context.Context, pluginConfig *PluginConfig, clusterRoleBindingName string) error {
+	return nil
+}
+
+func (f *fakeKubernetesService) ListClusterRoleBindings(ctx context.Context, pluginConfig *PluginConfig, prefix string, labelSelector string) ([]*RoleBindingDetails, error) {
+	return nil, nil
+}
+
+func (f *fakeKubernetesService) CheckAccess(ctx context.Context, pluginConfig *PluginConfig, namespace string, verb string, group string, resource string, subresource string) (*AccessReviewDetails, error) {
+	return &AccessReviewDetails{Allowed: true}, nil
+}
+
+func (f *fakeKubernetesService) ResetClients() {}
+
+// boundNamespaces returns the namespaces role bindings were created in, sorted by name
+func (f *fakeKubernetesService) boundNamespaces() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var namespaces []string
+	for _, rb := range f.roleBindings {
+		namespaces = append(namespaces, rb.Namespace)
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// testBackend returns a backend using the fake Kubernetes service, with a plugin config that has an admin role and
+// denies the kube-* namespaces
+func testBackend(t *testing.T) (*backend, *fakeKubernetesService, logical.Storage) {
+	t.Helper()
+	ctx := context.Background()
+
+	fake := &fakeKubernetesService{}
+	b := Backend(fake)
+	storage := &logical.InmemStorage{}
+	err := b.Setup(ctx, &logical.BackendConfig{
+		Logger:      log.NewNullLogger(),
+		System:      logical.TestSystemView(),
+		StorageView: storage,
+	})
+	if err != nil {
+		t.Fatalf("could not set up backend: %s", err)
+	}
+
+	err = saveConfigForCluster(ctx, storage, "", &PluginConfig{
+		MaxTTL:            3600,
+		DefaulTTL:         600,
+		AdminRole:         "admin",
+		ServiceAccountJWT: "jwt",
+		CACert:            "ca cert",
+		Host:              "https://127.0.0.1:6443",
+		DeniedNamespaces:  []string{"kube-*"},
+	})
+	if err != nil {
+		t.Fatalf("could not save config: %s", err)
+	}
+	return b, fake, storage
+}
+
+func handleRequest(t *testing.T, b *backend, storage logical.Storage, operation logical.Operation, path string, data map[string]interface{}) *logical.Response {
+	t.Helper()
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		ID:            "request-id",
+		Operation:     operation,
+		Path:          path,
+		Data:          data,
+		Storage:       storage,
+		MountAccessor: "k8s_1234",
+	})
+	if err != nil && (resp == nil || !resp.IsError()) {
+		t.Fatalf("request to %s failed: %s", path, err)
+	}
+	return resp
+}
+
+func TestReadForRoleAdditionalNamespaces(t *testing.T) {
+	tests := []struct {
+		name       string
+		role       map[string]interface{}
+		path       string
+		namespaces string
+		expected   []string
+		wantErr    string
+	}{
+		{
+			name:     "namespace from the path only",
+			role:     map[string]interface{}{keyClusterRoleName: "deployer"},
+			path:     "service_account/team-a/deployer",
+			expected: []string{"team-a"},
+		},
+		{
+			name:       "additional namespaces without opting in",
+			role:       map[string]interface{}{keyClusterRoleName: "deployer", keyAllowedNamespaces: "team-*"},
+			path:       "service_account/team-a/deployer",
+			namespaces: "team-b",
+			wantErr:    keyAllowAdditionalNamespaces,
+		},
+		{
+			name:       "additional namespaces for the built-in admin role",
+			path:       "service_account/team-a/admin",
+			namespaces: "team-b",
+			wantErr:    keyAllowAdditionalNamespaces,
+		},
+		{
+			name:       "additional namespaces allowed by the role",
+			role:       map[string]interface{}{keyClusterRoleName: "deployer", keyAllowedNamespaces: "team-*", keyAllowAdditionalNamespaces: true},
+			path:       "service_account/team-a/deployer",
+			namespaces: "team-b,team-c,team-a",
+			expected:   []string{"team-a", "team-b", "team-c"},
+		},
+		{
+			name:       "additional namespace outside the allowed namespaces of the role",
+			role:       map[string]interface{}{keyClusterRoleName: "deployer", keyAllowedNamespaces: "team-*", keyAllowAdditionalNamespaces: true},
+			path:       "service_account/team-a/deployer",
+			namespaces: "team-b,default",
+			wantErr:    "namespace 'default' is not allowed",
+		},
+		{
+			name:       "additional namespace denied by the cluster",
+			role:       map[string]interface{}{keyClusterRoleName: "deployer", keyAllowedNamespaces: "*", keyAllowAdditionalNamespaces: true},
+			path:       "service_account/team-a/deployer",
+			namespaces: "kube-system",
+			wantErr:    "namespace 'kube-system' is denied",
+		},
+		{
+			name:    "namespace in the path denied by the role",
+			role:    map[string]interface{}{keyClusterRoleName: "deployer", keyDeniedNamespaces: "team-a"},
+			path:    "service_account/team-a/deployer",
+			wantErr: "namespace 'team-a' is denied",
+		},
+		{
+			name:    "ClusterRole that does not exist",
+			role:    map[string]interface{}{keyClusterRoleName: "missing"},
+			path:    "service_account/team-a/deployer",
+			wantErr: "ClusterRole 'missing' does not exist",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, fake, storage := testBackend(t)
+
+			if tt.role != nil {
+				resp := handleRequest(t, b, storage, logical.UpdateOperation, rolesPath+"deployer", tt.role)
+				if resp.IsError() {
+					t.Fatalf("could not write role: %s", resp.Error())
+				}
+			}
+
+			data := map[string]interface{}{}
+			if tt.namespaces != "" {
+				data[keyNamespaces] = tt.namespaces
+			}
+			resp := handleRequest(t, b, storage, logical.ReadOperation, tt.path, data)
+
+			if tt.wantErr != "" {
+				if !resp.IsError() {
+					t.Fatalf("expected an error containing '%s'", tt.wantErr)
+				}
+				if !strings.Contains(resp.Error().Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing '%s', got '%s'", tt.wantErr, resp.Error())
+				}
+				if len(fake.serviceAccounts) > 0 {
+					t.Errorf("expected nothing to be created in the cluster, got service accounts %v", fake.serviceAccounts)
+				}
+				return
+			}
+
+			if resp.IsError() {
+				t.Fatalf("unexpected error: %s", resp.Error())
+			}
+			namespaces := fake.boundNamespaces()
+			if strings.Join(namespaces, ",") != strings.Join(tt.expected, ",") {
+				t.Errorf("expected role bindings in %v, got %v", tt.expected, namespaces)
+			}
+			for _, rb := range fake.roleBindings {
+				if rb.ServiceAccountNamespace != "team-a" {
+					t.Errorf("expected role binding in %s to bind the service account in team-a, got %s", rb.Namespace, rb.ServiceAccountNamespace)
+				}
+			}
+		})
+	}
+}
+
+func TestRoleValidateAdditionalNamespaces(t *testing.T) {
+	tests := []struct {
+		name    string
+		role    Role
+		wantErr bool
+	}{
+		{name: "with allowed namespaces", role: Role{ClusterRole: "deployer", AllowedNamespaces: []string{"team-*"}, AllowAdditionalNamespaces: true}},
+		{name: "without allowed namespaces", role: Role{ClusterRole: "deployer", AllowAdditionalNamespaces: true}, wantErr: true},
+		{name: "with an existing service account", role: Role{ServiceAccountName: "ci", AllowedNamespaces: []string{"ci"}, AllowAdditionalNamespaces: true}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.role.Validate()
+			if tt.wantErr && err == nil {
+				t.Fatal("expected an error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		})
+	}
+}
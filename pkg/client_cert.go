@@ -0,0 +1,27 @@
+package servian
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+)
+
+const keyClientCert = "client_cert"
+const keyClientKey = "client_key"
+const keyClientCertSubject = "client_cert_subject"
+const keyClientCertExpiry = "client_cert_expiry"
+
+// parseClientCertificate checks that the PEM encoded client key belongs to the client certificate, and returns the parsed
+// certificate
+func parseClientCertificate(cert string, key string) (*x509.Certificate, error) {
+	pair, err := tls.X509KeyPair([]byte(cert), []byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("%s and %s are not a valid key pair: %s", keyClientCert, keyClientKey, err)
+	}
+
+	certificate, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %s", keyClientCert, err)
+	}
+	return certificate, nil
+}
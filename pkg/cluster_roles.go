@@ -0,0 +1,107 @@
+package servian
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// clusterRoleCacheTTL is how long a ClusterRole that was found is assumed to exist before it is fetched again
+const clusterRoleCacheTTL = 30 * time.Second
+
+// clusterRoleCheckTimeout limits how long checking the ClusterRoles delays a config or role write, so a cluster that can
+// not be reached only results in a warning
+const clusterRoleCheckTimeout = 5 * time.Second
+
+// clusterRoleExists checks if a ClusterRole exists, reusing an earlier result until it is older than the cluster role cache
+// ttl. ClusterRoles that do not exist are not cached, so they can be used as soon as they are created
+func (b *backend) clusterRoleExists(ctx context.Context, pluginConfig *PluginConfig, clusterRoleName string) (bool, error) {
+	key := clientCacheKey(pluginConfig) + "/" + clusterRoleName
+	if _, ok := b.clusterRoleCache.get(key); ok {
+		return true, nil
+	}
+
+	_, err := b.kubernetesService.GetClusterRole(ctx, pluginConfig, clusterRoleName)
+	if err != nil && IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	b.clusterRoleCache.put(key, true)
+	return true, nil
+}
+
+// clusterRoleWarnings returns a warning for every ClusterRole that does not exist in the cluster, or could not be checked
+// within the cluster role check timeout. Missing ClusterRoles are only warned about when a config or role is written, as
+// they can be created afterwards
+func (b *backend) clusterRoleWarnings(ctx context.Context, pluginConfig *PluginConfig, cluster string, clusterRoleNames ...string) []string {
+	ctx, cancel := context.WithTimeout(ctx, clusterRoleCheckTimeout)
+	defer cancel()
+
+	clusterDescription := "the cluster"
+	if cluster != "" {
+		clusterDescription = fmt.Sprintf("cluster '%s'", cluster)
+	}
+
+	var warnings []string
+	for _, clusterRoleName := range clusterRoleNames {
+		if clusterRoleName == "" {
+			continue
+		}
+		exists, err := b.clusterRoleExists(ctx, pluginConfig, clusterRoleName)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("Could not check ClusterRole '%s' exists in %s: %s", clusterRoleName, clusterDescription, err))
+		} else if !exists {
+			warnings = append(warnings, fmt.Sprintf("ClusterRole '%s' does not exist in %s, service accounts bound to it will not have any permissions until it is created", clusterRoleName, clusterDescription))
+		}
+	}
+	return warnings
+}
+
+// roleClusterRoleWarnings checks the ClusterRole of a role exists in the cluster of the plugin config and all additional
+// clusters. The clusters are checked in parallel, so the write takes at most the cluster role check timeout
+func (b *backend) roleClusterRoleWarnings(ctx context.Context, s logical.Storage, role *Role) ([]string, error) {
+	if role.ClusterRole == "" {
+		return nil, nil
+	}
+
+	configs, err := loadAllClusterConfigs(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	warningsByCluster := map[string][]string{}
+	for cluster, pluginConfig := range configs {
+		wg.Add(1)
+		go func(cluster string, pluginConfig *PluginConfig) {
+			defer wg.Done()
+			warnings := b.clusterRoleWarnings(ctx, pluginConfig, cluster, role.ClusterRole)
+
+			lock.Lock()
+			defer lock.Unlock()
+			warningsByCluster[cluster] = warnings
+		}(cluster, pluginConfig)
+	}
+	wg.Wait()
+
+	// the warnings are returned in the order of the clusters, starting with the cluster of the plugin config
+	clusters := make([]string, 0, len(warningsByCluster))
+	for cluster := range warningsByCluster {
+		clusters = append(clusters, cluster)
+	}
+	sort.Strings(clusters)
+
+	var warnings []string
+	for _, cluster := range clusters {
+		warnings = append(warnings, warningsByCluster[cluster]...)
+	}
+	return warnings, nil
+}
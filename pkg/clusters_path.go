@@ -0,0 +1,223 @@
+package servian
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const keyCluster = "cluster"
+
+const clustersPath = "clusters/"
+
+func listClusters(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: clustersPath + "?$",
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ListOperation: &framework.PathOperation{
+				Callback: b.handleClusterList,
+				Summary:  "List the configured clusters",
+			},
+		},
+	}
+}
+
+func configureCluster(b *backend) *framework.Path {
+	fields := clusterFields()
+	fields[keyName] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "Name of the cluster, used in the path when requesting a service account",
+		Required:    true,
+	}
+
+	return &framework.Path{
+		Pattern: clustersPath + framework.GenericNameRegex(keyName),
+		Fields:  fields,
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.CreateOperation: &framework.PathOperation{
+				Callback: b.handleClusterWrite,
+				Summary:  "Configure a cluster",
+			},
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.handleClusterWrite,
+				Summary:  "Configure a cluster",
+			},
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.handleClusterRead,
+				Summary:  "Read cluster configuration",
+			},
+			logical.DeleteOperation: &framework.PathOperation{
+				Callback: b.handleClusterDelete,
+				Summary:  "Delete a cluster",
+			},
+		},
+	}
+}
+
+func (b *backend) handleClusterList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	clusters, err := req.Storage.List(ctx, clustersPath)
+	if err != nil {
+		return nil, err
+	}
+	return logical.ListResponse(clusters), nil
+}
+
+func (b *backend) handleClusterWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+
+	stored, err := loadClusterConfig(ctx, req.Storage, d.Get(keyName).(string))
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := clusterConfigFromFieldData(d, stored)
+	if err != nil {
+		return logical.ErrorResponse("Configuration not valid: %s", err), err
+	}
+
+	err = config.Validate()
+
+	if err != nil {
+		return logical.ErrorResponse("Configuration not valid: %s", err), err
+	}
+
+	resp, failed, err := b.verifyConfig(ctx, req, config, d.Get(keySkipVerify).(bool))
+	if err != nil || failed {
+		return resp, err
+	}
+
+	entry, err := logical.StorageEntryJSON(clustersPath+d.Get(keyName).(string), config)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+	b.kubernetesService.ResetClients()
+	return resp, nil
+}
+
+func (b *backend) handleClusterRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	if config, err := loadClusterConfig(ctx, req.Storage, d.Get(keyName).(string)); err != nil {
+		return nil, err
+	} else if config == nil {
+		return nil, nil
+	} else {
+
+		resp := &logical.Response{
+			Data: config.clusterResponseData(),
+		}
+		return resp, nil
+	}
+}
+
+func (b *backend) handleClusterDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get(keyName).(string)
+
+	// leases and write-ahead log entries of the cluster can only be revoked or rolled back with its configuration
+	leases, err := countClusterLeases(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if leases > 0 {
+		return logical.ErrorResponse("Cluster '%s' still has %d outstanding leases, revoke them before deleting the cluster", name, leases), nil
+	}
+	pending, err := countClusterWALs(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if pending > 0 {
+		return logical.ErrorResponse("Cluster '%s' still has %d credentials waiting to be rolled back, try again later", name, pending), nil
+	}
+
+	if err := req.Storage.Delete(ctx, clustersPath+name); err != nil {
+		return nil, err
+	}
+	b.kubernetesService.ResetClients()
+	return nil, nil
+}
+
+// loadClusterConfig is a helper function to simplify the loading of a cluster configuration from the logical store
+func loadClusterConfig(ctx context.Context, s logical.Storage, name string) (*PluginConfig, error) {
+	raw, err := s.Get(ctx, clustersPath+name)
+	if err != nil {
+		return nil, err
+	}
+	if raw == nil {
+		return nil, nil
+	}
+	conf := &PluginConfig{}
+	if err := json.Unmarshal(raw.Value, conf); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// loadConfigForCluster loads the configuration for the named cluster, or the plugin configuration when no cluster is named
+func loadConfigForCluster(ctx context.Context, s logical.Storage, cluster string) (*PluginConfig, error) {
+	if cluster == "" {
+		config, err := loadPluginConfig(ctx, s)
+		if err != nil {
+			return nil, err
+		}
+		if config == nil {
+			return nil, fmt.Errorf("plugin is not configured, configure it using the '%s' path", configPath)
+		}
+		return config, nil
+	}
+
+	config, err := loadClusterConfig(ctx, s, cluster)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return nil, fmt.Errorf("Cluster '%s' is not configured", cluster)
+	}
+	return config, nil
+}
+
+// saveConfigForCluster stores the configuration for the named cluster, or the plugin configuration when no cluster is named
+func saveConfigForCluster(ctx context.Context, s logical.Storage, cluster string, config *PluginConfig) error {
+	key := configPath
+	if cluster != "" {
+		key = clustersPath + cluster
+	}
+
+	entry, err := logical.StorageEntryJSON(key, config)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+// loadAllClusterConfigs loads the plugin configuration and the configuration of every cluster, keyed by cluster name with
+// the plugin configuration under an empty name when it is configured
+func loadAllClusterConfigs(ctx context.Context, s logical.Storage) (map[string]*PluginConfig, error) {
+	configs := map[string]*PluginConfig{}
+
+	config, err := loadPluginConfig(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	if config != nil {
+		configs[""] = config
+	}
+
+	clusters, err := s.List(ctx, clustersPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, cluster := range clusters {
+		config, err := loadClusterConfig(ctx, s, cluster)
+		if err != nil {
+			return nil, err
+		}
+		if config != nil {
+			configs[cluster] = config
+		}
+	}
+
+	return configs, nil
+}
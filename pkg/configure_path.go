@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/url"
+	"time"
 
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
@@ -18,6 +19,27 @@ const keyJWT = "jwt"
 const keyCACert = "ca_cert"
 const keyHost = "host"
 const keyDefaultTTL = "ttl"
+const keyLegacyTokenSecret = "legacy_token_secret"
+const keyRootTokenTTL = "root_token_ttl"
+const keyRootRotationPeriod = "root_rotation_period"
+const keyLastRootRotation = "last_root_rotation"
+const keyRootTokenExpiry = "root_token_expiry"
+const keyNextRootRotation = "next_root_rotation"
+const keyTidyPeriod = "tidy_period"
+const keyRequestTimeout = "request_timeout"
+const keyTokenTimeout = "token_timeout"
+const keyUseInClusterConfig = "use_in_cluster_config"
+const keyJWTSet = "jwt_set"
+const keyClientCertSet = "client_cert_set"
+const keyJWTIssuer = "jwt_issuer"
+const keyJWTSubject = "jwt_subject"
+const keyJWTExpiry = "jwt_expiry"
+const keyJWTFingerprint = "jwt_fingerprint"
+
+// maxRequestTimeout and maxTokenTimeout keep creating a credential well within the write-ahead log rollback min age, after
+// which the objects of a request that is still running would be rolled back
+const maxRequestTimeout = time.Minute
+const maxTokenTimeout = time.Minute
 
 const configPath = "config"
 
@@ -31,53 +53,48 @@ type PluginConfig struct {
 	ServiceAccountJWT string `json:"jwt"`
 	CACert            string `json:"ca_cert"`
 	Host              string `json:"host"`
+	LegacyTokenSecret bool   `json:"legacy_token_secret"`
+
+	UseInClusterConfig bool `json:"use_in_cluster_config"`
+
+	// ClientCert and ClientKey authenticate the plugin with a client certificate instead of the jwt
+	ClientCert string `json:"client_cert"`
+	ClientKey  string `json:"client_key"`
+
+	RootTokenTTL       int       `json:"root_token_ttl"`
+	RootRotationPeriod int       `json:"root_rotation_period"`
+	LastRootRotation   time.Time `json:"last_root_rotation"`
+
+	// RootTokenExpiry is when the token requested by the last rotation expires, which can be earlier than root_token_ttl
+	// when the API server limits the lifetime of tokens
+	RootTokenExpiry time.Time `json:"root_token_expiry"`
+
+	TidyPeriod     int `json:"tidy_period"`
+	RequestTimeout int `json:"request_timeout"`
+	TokenTimeout   int `json:"token_timeout"`
+
+	AllowedNamespaces []string `json:"allowed_namespaces"`
+	DeniedNamespaces  []string `json:"denied_namespaces"`
 }
 
 func configurePlugin(b *backend) *framework.Path {
+	fields := clusterFields()
+	fields[keyAdminRole] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "Name of Kubernetes Admin ClusterRole that can be assigned to service accounts created by this plugin. Used for the 'admin' role when no role with that name exists under roles/.",
+	}
+	fields[keyEditorRole] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "Name of Kubernetes Editor ClusterRole that can be assigned to service accounts created by this plugin. Used for the 'editor' role when no role with that name exists under roles/.",
+	}
+	fields[keyViewerRole] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "Name of Kubernetes Viewer ClusterRole that can be assigned to service accounts created by this plugin. Used for the 'viewer' role when no role with that name exists under roles/.",
+	}
+
 	return &framework.Path{
 		Pattern: "config",
-		Fields: map[string]*framework.FieldSchema{
-			keyMaxTTL: {
-				Type:        framework.TypeDurationSecond,
-				Description: "Time to live for the credentials returned. If not set or set to 0, will use system default.",
-				Default:     "1h",
-			},
-			keyDefaultTTL: {
-				Type:        framework.TypeDurationSecond,
-				Description: "Deafult time to live for when a user does not provide a TTL. If not set or set to 0, will use system default.",
-				Default:     "10m",
-			},
-			keyAdminRole: {
-				Type:        framework.TypeString,
-				Description: "Name of Kubernetes Admin ClusterRole that can be assigned to service accounts created by this plugin.",
-				Required:    true,
-			},
-			keyEditorRole: {
-				Type:        framework.TypeString,
-				Description: "Name of Kubernetes Editor ClusterRole that can be assigned to service accounts created by this plugin.",
-				Required:    true,
-			},
-			keyViewerRole: {
-				Type:        framework.TypeString,
-				Description: "Name of Kubernetes Viewer ClusterRole that can be assigned to service accounts created by this plugin.",
-				Required:    true,
-			},
-			keyJWT: {
-				Type:        framework.TypeString,
-				Description: "JTW for the service account used to create and remove credentials in the Kubernetes Cluster",
-				Required:    true,
-			},
-			keyCACert: {
-				Type:        framework.TypeString,
-				Description: "CA cert from the Kubernetes Cluster, to validate the connection",
-				Required:    true,
-			},
-			keyHost: {
-				Type:        framework.TypeString,
-				Description: "URL for kubernetes cluster for vault to use to comunicate to k8s. https://{url}:{port}",
-				Required:    true,
-			},
-		},
+		Fields:  fields,
 		Operations: map[logical.Operation]framework.OperationHandler{
 			logical.CreateOperation: &framework.PathOperation{
 				Callback: b.handleConfigWrite,
@@ -95,25 +112,304 @@ func configurePlugin(b *backend) *framework.Path {
 	}
 }
 
+// clusterFields returns the fields needed to connect to a Kubernetes cluster, shared by the config and clusters/ paths
+func clusterFields() map[string]*framework.FieldSchema {
+	return map[string]*framework.FieldSchema{
+		keyMaxTTL: {
+			Type:        framework.TypeDurationSecond,
+			Description: "Time to live for the credentials returned. If not set or set to 0, will use system default.",
+			Default:     "1h",
+		},
+		keyDefaultTTL: {
+			Type:        framework.TypeDurationSecond,
+			Description: "Deafult time to live for when a user does not provide a TTL. If not set or set to 0, will use system default.",
+			Default:     "10m",
+		},
+		keyJWT: {
+			Type:        framework.TypeString,
+			Description: "JTW for the service account used to create and remove credentials in the Kubernetes Cluster. Write only, reads only report its claims and fingerprint. Required unless use_in_cluster_config or client_cert is set.",
+		},
+		keyCACert: {
+			Type:        framework.TypeString,
+			Description: "CA cert from the Kubernetes Cluster, to validate the connection. Required unless use_in_cluster_config is set.",
+		},
+		keyHost: {
+			Type:        framework.TypeString,
+			Description: "URL for kubernetes cluster for vault to use to comunicate to k8s. https://{url}:{port}. When use_in_cluster_config is set, it is only used in the generated kube configs.",
+		},
+		keyClientCert: {
+			Type:        framework.TypeString,
+			Description: "PEM encoded client certificate to authenticate to the Kubernetes Cluster with instead of a jwt. Requires client_key. Write only, reads only report its subject and expiry.",
+		},
+		keyClientKey: {
+			Type:        framework.TypeString,
+			Description: "PEM encoded private key of the client certificate. Write only.",
+		},
+		keyKubeConfigDocument: {
+			Type:        framework.TypeString,
+			Description: "Kubeconfig to read the host, CA cert and token or client certificate from, instead of setting them separately. Only settings embedded in the kubeconfig are supported. Write only.",
+		},
+		keyKubeConfigContext: {
+			Type:        framework.TypeString,
+			Description: "Context of the kubeconfig to read the connection settings from. If not set, the current-context of the kubeconfig is used.",
+		},
+		keySkipVerify: {
+			Type:        framework.TypeBool,
+			Description: "Save the configuration without checking that the Kubernetes API can be reached and the plugin has the permissions it needs.",
+			Default:     false,
+		},
+		keyUseInClusterConfig: {
+			Type:        framework.TypeBool,
+			Description: "Connect to the cluster vault runs in with the token and CA cert of the pod, re-reading the token as Kubernetes rotates it. Can not be combined with jwt or ca_cert.",
+			Default:     false,
+		},
+		keyLegacyTokenSecret: {
+			Type:        framework.TypeBool,
+			Description: "Read the token from the service account token secret generated by Kubernetes instead of using the TokenRequest API. Only works on clusters that still generate token secrets (before 1.24).",
+			Default:     false,
+		},
+		keyRootTokenTTL: {
+			Type:        framework.TypeDurationSecond,
+			Description: "Time to live of the token requested for the plugin's own service account when the jwt is rotated.",
+			Default:     "768h",
+		},
+		keyRootRotationPeriod: {
+			Type:        framework.TypeDurationSecond,
+			Description: "How often the jwt is rotated automatically. If not set or set to 0, the jwt is only rotated using the rotate-root path.",
+		},
+		keyRequestTimeout: {
+			Type:        framework.TypeDurationSecond,
+			Description: "Time to wait for a response from the Kubernetes API before a request fails, at most 1m. If set to 0, requests only fail when the vault request is cancelled.",
+			Default:     "30s",
+		},
+		keyTokenTimeout: {
+			Type:        framework.TypeDurationSecond,
+			Description: "Time to wait for Kubernetes to generate the token secret of a new service account when legacy_token_secret is set, at most 1m.",
+			Default:     "10s",
+		},
+		keyTidyPeriod: {
+			Type:        framework.TypeDurationSecond,
+			Description: "How often service accounts and role bindings that outlived their lease are removed automatically. If not set or set to 0, they are only removed using the tidy path.",
+		},
+		keyAllowedNamespaces: {
+			Type:        framework.TypeCommaStringSlice,
+			Description: "List of namespace patterns service accounts can be created in for any role, e.g. 'team-*'. If not set, all namespaces are allowed.",
+		},
+		keyDeniedNamespaces: {
+			Type:        framework.TypeCommaStringSlice,
+			Description: "List of namespace patterns service accounts can never be created in for any role, e.g. 'kube-*'. Takes precedence over allowed_namespaces.",
+		},
+	}
+}
+
+// configField returns the value of a field when it is set in the request, or its default when a new config is created.
+// Fields that are not set are left unchanged when an existing config is updated
+func configField(d *framework.FieldData, key string, create bool) (interface{}, bool) {
+	if value, ok := d.GetOk(key); ok {
+		return value, true
+	}
+	if create {
+		return d.Get(key), true
+	}
+	return nil, false
+}
+
+// clusterConfigFromFieldData reads the fields returned by clusterFields into the stored config, or a new config when
+// nothing is stored yet, reading the connection settings from the kubeconfig when one is given. The stored jwt and client
+// certificate are kept unless new credentials are set in the request, as they are write only
+func clusterConfigFromFieldData(d *framework.FieldData, stored *PluginConfig) (*PluginConfig, error) {
+	config := &PluginConfig{}
+	if stored != nil {
+		*config = *stored
+	}
+	create := stored == nil
+
+	if v, ok := configField(d, keyMaxTTL, create); ok {
+		config.MaxTTL = v.(int)
+	}
+	if v, ok := configField(d, keyDefaultTTL, create); ok {
+		config.DefaulTTL = v.(int)
+	}
+	if v, ok := configField(d, keyCACert, create); ok {
+		config.CACert = v.(string)
+	}
+	if v, ok := configField(d, keyHost, create); ok {
+		config.Host = v.(string)
+	}
+	if v, ok := configField(d, keyLegacyTokenSecret, create); ok {
+		config.LegacyTokenSecret = v.(bool)
+	}
+	if v, ok := configField(d, keyUseInClusterConfig, create); ok {
+		config.UseInClusterConfig = v.(bool)
+	}
+	if v, ok := configField(d, keyRootTokenTTL, create); ok {
+		config.RootTokenTTL = v.(int)
+	}
+	if v, ok := configField(d, keyRootRotationPeriod, create); ok {
+		config.RootRotationPeriod = v.(int)
+	}
+	if v, ok := configField(d, keyTidyPeriod, create); ok {
+		config.TidyPeriod = v.(int)
+	}
+	if v, ok := configField(d, keyRequestTimeout, create); ok {
+		config.RequestTimeout = v.(int)
+	}
+	if v, ok := configField(d, keyTokenTimeout, create); ok {
+		config.TokenTimeout = v.(int)
+	}
+	if v, ok := configField(d, keyAllowedNamespaces, create); ok {
+		config.AllowedNamespaces = v.([]string)
+	}
+	if v, ok := configField(d, keyDeniedNamespaces, create); ok {
+		config.DeniedNamespaces = v.([]string)
+	}
+
+	// new credentials replace all stored credentials, so the plugin can switch between a jwt and a client certificate
+	_, jwtSet := d.GetOk(keyJWT)
+	_, clientCertSet := d.GetOk(keyClientCert)
+	_, clientKeySet := d.GetOk(keyClientKey)
+	if jwtSet || clientCertSet || clientKeySet {
+		config.ServiceAccountJWT = d.Get(keyJWT).(string)
+		config.ClientCert = d.Get(keyClientCert).(string)
+		config.ClientKey = d.Get(keyClientKey).(string)
+		config.LastRootRotation = time.Time{}
+		config.RootTokenExpiry = time.Time{}
+	} else if config.UseInClusterConfig {
+		// the token and CA cert of the pod replace the stored credentials
+		config.ServiceAccountJWT = ""
+		config.ClientCert = ""
+		config.ClientKey = ""
+		config.LastRootRotation = time.Time{}
+		config.RootTokenExpiry = time.Time{}
+		if _, ok := d.GetOk(keyCACert); !ok {
+			config.CACert = ""
+		}
+	}
+
+	kubeConfig := d.Get(keyKubeConfigDocument).(string)
+	if kubeConfig == "" {
+		return config, nil
+	}
+
+	_, caCertSet := d.GetOk(keyCACert)
+	_, hostSet := d.GetOk(keyHost)
+	if jwtSet || clientCertSet || clientKeySet || caCertSet || hostSet || d.Get(keyUseInClusterConfig).(bool) {
+		return nil, fmt.Errorf("%s can not be combined with %s, %s, %s, %s, %s or %s", keyKubeConfigDocument, keyJWT, keyCACert, keyHost, keyClientCert, keyClientKey, keyUseInClusterConfig)
+	}
+
+	connection, err := parseKubeConfig(kubeConfig, d.Get(keyKubeConfigContext).(string))
+	if err != nil {
+		return nil, err
+	}
+	config.Host = connection.Host
+	config.CACert = connection.CACert
+	config.ServiceAccountJWT = connection.Token
+	config.ClientCert = connection.ClientCert
+	config.ClientKey = connection.ClientKey
+	config.UseInClusterConfig = false
+	config.LastRootRotation = time.Time{}
+	config.RootTokenExpiry = time.Time{}
+	return config, nil
+}
+
+// clusterResponseData returns the fields returned by clusterFields for read responses. Secret fields are never returned,
+// instead the response describes the configured JWT or client certificate so operators can tell which credential is in use
+func (c *PluginConfig) clusterResponseData() map[string]interface{} {
+	data := map[string]interface{}{
+		keyMaxTTL:            c.MaxTTL,
+		keyDefaultTTL:        c.DefaulTTL,
+		keyCACert:            c.CACert,
+		keyHost:              c.Host,
+		keyLegacyTokenSecret: c.LegacyTokenSecret,
+		keyJWTSet:            c.ServiceAccountJWT != "",
+		keyClientCertSet:     c.ClientCert != "",
+
+		keyUseInClusterConfig: c.UseInClusterConfig,
+
+		keyRootTokenTTL:       c.RootTokenTTL,
+		keyRootRotationPeriod: c.RootRotationPeriod,
+		keyTidyPeriod:         c.TidyPeriod,
+		keyRequestTimeout:     c.RequestTimeout,
+		keyTokenTimeout:       c.TokenTimeout,
+		keyAllowedNamespaces:  c.AllowedNamespaces,
+		keyDeniedNamespaces:   c.DeniedNamespaces,
+	}
+
+	if !c.LastRootRotation.IsZero() {
+		data[keyLastRootRotation] = c.LastRootRotation.UTC().Format(time.RFC3339)
+	}
+	if !c.RootTokenExpiry.IsZero() {
+		data[keyRootTokenExpiry] = c.RootTokenExpiry.UTC().Format(time.RFC3339)
+	}
+	if next := c.nextRootRotation(); !next.IsZero() {
+		data[keyNextRootRotation] = next.UTC().Format(time.RFC3339)
+	}
+
+	if c.ServiceAccountJWT != "" {
+		data[keyJWTFingerprint] = fingerprint(c.ServiceAccountJWT)
+
+		// the claims are informational only, a token that can not be decoded is still reported by its fingerprint
+		if claims, err := parseJWTClaims(c.ServiceAccountJWT); err == nil {
+			data[keyJWTIssuer] = claims.Issuer
+			data[keyJWTSubject] = claims.Subject
+			if claims.ExpiresAt > 0 {
+				data[keyJWTExpiry] = time.Unix(claims.ExpiresAt, 0).UTC().Format(time.RFC3339)
+			}
+		}
+	}
+
+	if c.ClientCert != "" {
+		if certificate, err := parseClientCertificate(c.ClientCert, c.ClientKey); err == nil {
+			data[keyClientCertSubject] = certificate.Subject.String()
+			data[keyClientCertExpiry] = certificate.NotAfter.UTC().Format(time.RFC3339)
+		}
+	}
+
+	return data
+}
+
 func (b *backend) handleConfigWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
 
-	config := PluginConfig{
-		MaxTTL:            d.Get(keyMaxTTL).(int),
-		DefaulTTL:         d.Get(keyDefaultTTL).(int),
-		AdminRole:         d.Get(keyAdminRole).(string),
-		EditorRole:        d.Get(keyEditorRole).(string),
-		ViewerRole:        d.Get(keyViewerRole).(string),
-		ServiceAccountJWT: d.Get(keyJWT).(string),
-		CACert:            d.Get(keyCACert).(string),
-		Host:              d.Get(keyHost).(string),
+	stored, err := loadPluginConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
 	}
 
-	err := config.Validate()
+	config, err := clusterConfigFromFieldData(d, stored)
+	if err != nil {
+		return logical.ErrorResponse("Configuration not valid: %s", err), err
+	}
+	if v, ok := configField(d, keyAdminRole, stored == nil); ok {
+		config.AdminRole = v.(string)
+	}
+	if v, ok := configField(d, keyEditorRole, stored == nil); ok {
+		config.EditorRole = v.(string)
+	}
+	if v, ok := configField(d, keyViewerRole, stored == nil); ok {
+		config.ViewerRole = v.(string)
+	}
+
+	err = config.Validate()
 
 	if err != nil {
 		return logical.ErrorResponse("Configuration not valid: %s", err), err
 	}
 
+	resp, failed, err := b.verifyConfig(ctx, req, config, d.Get(keySkipVerify).(bool))
+	if err != nil || failed {
+		return resp, err
+	}
+
+	// the ClusterRoles are checked even when skip_verify is set, a cluster that can not be reached only results in warnings
+	if warnings := b.clusterRoleWarnings(ctx, config, "", config.AdminRole, config.EditorRole, config.ViewerRole); len(warnings) > 0 {
+		if resp == nil {
+			resp = &logical.Response{}
+		}
+		for _, warning := range warnings {
+			resp.AddWarning(warning)
+		}
+	}
+
 	entry, err := logical.StorageEntryJSON(configPath, config)
 	if err != nil {
 		return nil, err
@@ -121,7 +417,8 @@ func (b *backend) handleConfigWrite(ctx context.Context, req *logical.Request, d
 	if err := req.Storage.Put(ctx, entry); err != nil {
 		return nil, err
 	}
-	return nil, nil
+	b.kubernetesService.ResetClients()
+	return resp, nil
 }
 
 func (b *backend) handleConfigRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
@@ -131,17 +428,13 @@ func (b *backend) handleConfigRead(ctx context.Context, req *logical.Request, d
 		return nil, nil
 	} else {
 
+		data := config.clusterResponseData()
+		data[keyAdminRole] = config.AdminRole
+		data[keyEditorRole] = config.EditorRole
+		data[keyViewerRole] = config.ViewerRole
+
 		resp := &logical.Response{
-			Data: map[string]interface{}{
-				keyMaxTTL:     config.MaxTTL,
-				keyDefaultTTL: config.DefaulTTL,
-				keyAdminRole:  config.AdminRole,
-				keyEditorRole: config.EditorRole,
-				keyViewerRole: config.ViewerRole,
-				keyJWT:        config.ServiceAccountJWT,
-				keyCACert:     config.CACert,
-				keyHost:       config.Host,
-			},
+			Data: data,
 		}
 		return resp, nil
 	}
@@ -171,24 +464,74 @@ func (c *PluginConfig) Validate() error {
 		return fmt.Errorf("Host '%s' not a valid host: %s", c.Host, err)
 	}
 
-	if c.AdminRole == "" {
-		return fmt.Errorf("%s can not be empty", keyAdminRole)
+	if c.UseInClusterConfig {
+		if c.ServiceAccountJWT != "" || c.CACert != "" || c.ClientCert != "" || c.ClientKey != "" {
+			return fmt.Errorf("%s, %s, %s and %s can not be set when %s is set", keyJWT, keyCACert, keyClientCert, keyClientKey, keyUseInClusterConfig)
+		}
+
+		// the token of the pod is rotated by Kubernetes
+		if c.RootRotationPeriod > 0 {
+			return fmt.Errorf("%s can not be set when %s is set", keyRootRotationPeriod, keyUseInClusterConfig)
+		}
+	} else {
+		if c.ServiceAccountJWT == "" && c.ClientCert == "" {
+			return fmt.Errorf("%s or %s must be set", keyJWT, keyClientCert)
+		}
+
+		if c.ServiceAccountJWT != "" && c.ClientCert != "" {
+			return fmt.Errorf("%s and %s can not both be set", keyJWT, keyClientCert)
+		}
+
+		if (c.ClientCert == "") != (c.ClientKey == "") {
+			return fmt.Errorf("%s and %s must be set together", keyClientCert, keyClientKey)
+		}
+
+		if c.ClientCert != "" {
+			if _, err := parseClientCertificate(c.ClientCert, c.ClientKey); err != nil {
+				return err
+			}
+		}
+
+		if c.CACert == "" {
+			return fmt.Errorf("%s can not be empty", keyCACert)
+		}
+
+		// only a jwt can be rotated
+		if c.ServiceAccountJWT == "" && c.RootRotationPeriod > 0 {
+			return fmt.Errorf("%s can not be set without a %s", keyRootRotationPeriod, keyJWT)
+		}
+	}
+
+	if c.RootRotationPeriod < 0 {
+		return fmt.Errorf("%s can not be negative", keyRootRotationPeriod)
+	}
+
+	if c.TidyPeriod < 0 {
+		return fmt.Errorf("%s can not be negative", keyTidyPeriod)
+	}
+
+	if c.RequestTimeout < 0 {
+		return fmt.Errorf("%s can not be negative", keyRequestTimeout)
+	}
+
+	if time.Duration(c.RequestTimeout)*time.Second > maxRequestTimeout {
+		return fmt.Errorf("%s can not be longer than %s", keyRequestTimeout, maxRequestTimeout)
 	}
 
-	if c.EditorRole == "" {
-		return fmt.Errorf("%s can not be empty", keyEditorRole)
+	if c.TokenTimeout < 0 {
+		return fmt.Errorf("%s can not be negative", keyTokenTimeout)
 	}
 
-	if c.ViewerRole == "" {
-		return fmt.Errorf("%s can not be empty", keyViewerRole)
+	if time.Duration(c.TokenTimeout)*time.Second > maxTokenTimeout {
+		return fmt.Errorf("%s can not be longer than %s", keyTokenTimeout, maxTokenTimeout)
 	}
 
-	if c.ServiceAccountJWT == "" {
-		return fmt.Errorf("%s can not be empty", keyJWT)
+	if err := validateNamespacePatterns(keyAllowedNamespaces, c.AllowedNamespaces); err != nil {
+		return err
 	}
 
-	if c.CACert == "" {
-		return fmt.Errorf("%s can not be empty", keyCACert)
+	if err := validateNamespacePatterns(keyDeniedNamespaces, c.DeniedNamespaces); err != nil {
+		return err
 	}
 
 	return nil
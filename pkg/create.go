@@ -3,7 +3,9 @@ package servian
 import (
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/errwrap"
@@ -25,6 +27,10 @@ func secret(b *backend) *framework.Secret {
 				Type:        framework.TypeString,
 				Description: "Namespace in which the service account will be created",
 			},
+			keyNamespaces: &framework.FieldSchema{
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Namespaces the service account has access to",
+			},
 			keyServiceAccountToken: &framework.FieldSchema{
 				Type:        framework.TypeString,
 				Description: "The Service account token associated with the newly created service account",
@@ -41,116 +47,448 @@ func secret(b *backend) *framework.Secret {
 				Type:        framework.TypeString,
 				Description: "Name of the newly created role binding",
 			},
+			keyClusterRoleBindingName: &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Name of the newly created cluster role binding",
+			},
 		},
+		Renew:  b.renewSecret,
 		Revoke: b.revokeSecret,
 	}
 }
 
-func (b *backend) createSecret(ctx context.Context, s logical.Storage, saType string, namespace string, ttl int) (*logical.Response, error) {
+// createSecret creates a service account in the namespace, bound to the role in each of the target namespaces, or in all
+// namespaces when the credential is cluster wide
+func (b *backend) createSecret(ctx context.Context, req *logical.Request, pluginConfig *PluginConfig, cluster string, role *Role, namespace string, targetNamespaces []string, ttl int, clusterWide bool) (*logical.Response, error) {
 
-	// reload plugin config on every call to prevent stale config
-	pluginConfig, err := loadPluginConfig(ctx, s)
-	if err != nil {
-		return nil, err
+	ttl = getTTL(b.System(), pluginConfig, role, ttl)
+
+	// tidy removes the objects of a lease once it expires, so the expiry can not be at the time the lease is issued
+	if ttl <= 0 {
+		return nil, fmt.Errorf("could not work out a ttl for role '%s', the mount has no default lease ttl", role.Name)
 	}
 
-	roleName, err := getClusterRoleName(pluginConfig, saType)
+	dur, err := time.ParseDuration(fmt.Sprintf("%ds", ttl))
 	if err != nil {
-		return nil, err
+		return nil, errwrap.Wrapf(fmt.Sprintf("ttl: %d could not be parse due to error: %s", ttl, err), err)
 	}
+	expiresAt := time.Now().Add(dur)
+	metadata := objectMetadata(req, role, expiresAt)
 
-	if ttl <= 0 {
-		ttl = pluginConfig.DefaulTTL
+	entry := &walCredential{
+		Cluster:            cluster,
+		Namespace:          namespace,
+		ServiceAccountName: generateName(serviceAccountNamePrefix),
+	}
+	if clusterWide {
+		entry.ClusterRoleBindingName = generateName(clusterRoleBindingNamePrefix)
+	}
+	for _, target := range targetNamespaces {
+		binding := namespaceBinding{
+			Namespace:       target,
+			RoleBindingName: generateName(roleBindingNamePrefix),
+		}
+		if role.Rules != "" {
+			binding.RoleName = generateName(roleNamePrefix)
+		}
+		entry.Bindings = append(entry.Bindings, binding)
 	}
 
-	if ttl > pluginConfig.MaxTTL {
-		ttl = pluginConfig.MaxTTL
+	// record the objects before they are created, so they are rolled back if vault stops before the credential is returned
+	walID, err := framework.PutWAL(ctx, req.Storage, walKindCredential, entry)
+	if err != nil {
+		return nil, errwrap.Wrapf("error writing write-ahead log: {{err}}", err)
 	}
 
-	b.Logger().Info(fmt.Sprintf("creating secret with ttl: %d for role: %s in namespace: %s", ttl, roleName, namespace))
-	sa, err := b.kubernetesService.CreateServiceAccount(pluginConfig, namespace)
+	// only the objects created by this request are cleaned up when it fails, an object with a generated name that was
+	// not created yet can belong to another lease
+	created := &walCredential{
+		Cluster:   cluster,
+		Namespace: namespace,
+	}
 
+	b.Logger().Info(fmt.Sprintf("creating secret with ttl: %d for role: %s in namespace: %s", ttl, role.Name, namespace))
+	var sa *ServiceAccountDetails
+	err = b.createWithUniqueName(ctx, req.Storage, &walID, entry, &entry.ServiceAccountName, serviceAccountNamePrefix, func() error {
+		var err error
+		sa, err = b.kubernetesService.CreateServiceAccount(ctx, pluginConfig, namespace, entry.ServiceAccountName, metadata)
+		return err
+	})
 	if err != nil {
 		b.Logger().Error(fmt.Sprintf("Error creating Kubernetes service account: %s", err))
+		b.cleanupCredential(ctx, req.Storage, pluginConfig, walID, created)
 		return nil, err
 	}
+	created.ServiceAccountName = sa.Name
 
-	// give the kubernetes cluster a chance to generate the secret for the SA
-	time.Sleep(1 * time.Second)
-
-	secrets, err := b.kubernetesService.GetServiceAccountSecret(pluginConfig, sa)
+	token, err := b.getServiceAccountToken(ctx, pluginConfig, sa, ttl)
 	if err != nil {
-		b.Logger().Error(fmt.Sprintf("Error loading secrets for service account: %s", err))
-		b.kubernetesService.DeleteServiceAccount(pluginConfig, sa.Namespace, sa.Name)
+		b.Logger().Error(fmt.Sprintf("Error getting token for service account: %s", err))
+		b.cleanupCredential(ctx, req.Storage, pluginConfig, walID, created)
 		return nil, err
 	}
 
-	if len(secrets) != 1 {
-		b.kubernetesService.DeleteServiceAccount(pluginConfig, sa.Namespace, sa.Name)
-		return nil, fmt.Errorf("More than 1 secret found with the newly created service account, this is unexpected for the prupose of this plugin, please try again")
+	if clusterWide {
+		err := b.createWithUniqueName(ctx, req.Storage, &walID, entry, &entry.ClusterRoleBindingName, clusterRoleBindingNamePrefix, func() error {
+			_, err := b.kubernetesService.CreateClusterRoleBinding(ctx, pluginConfig, entry.ClusterRoleBindingName, namespace, sa.Name, role.ClusterRole, metadata)
+			return err
+		})
+		if err != nil {
+			b.Logger().Error(fmt.Sprintf("Error setting up Kubernetes cluster role binding for SA %s: %s", sa.Name, err))
+			b.cleanupCredential(ctx, req.Storage, pluginConfig, walID, created)
+			return nil, err
+		}
+		created.ClusterRoleBindingName = entry.ClusterRoleBindingName
 	}
 
-	rb, err := b.kubernetesService.CreateRoleBinding(pluginConfig, namespace, sa.Name, roleName)
+	for i := range entry.Bindings {
+		binding := &entry.Bindings[i]
+		created.Bindings = append(created.Bindings, namespaceBinding{Namespace: binding.Namespace})
+		createdBinding := &created.Bindings[len(created.Bindings)-1]
+
+		// roles with inline rules get a role of their own for every lease, other roles bind an existing cluster role
+		bindKind, bindName := clusterRoleKind, role.ClusterRole
+		if binding.RoleName != "" {
+			err := b.createWithUniqueName(ctx, req.Storage, &walID, entry, &binding.RoleName, roleNamePrefix, func() error {
+				_, err := b.kubernetesService.CreateRole(ctx, pluginConfig, binding.Namespace, binding.RoleName, role.Rules, metadata)
+				return err
+			})
+			if err != nil {
+				b.Logger().Error(fmt.Sprintf("Error creating Kubernetes role for SA %s in namespace: %s: %s", sa.Name, binding.Namespace, err))
+				b.cleanupCredential(ctx, req.Storage, pluginConfig, walID, created)
+				return nil, err
+			}
+			createdBinding.RoleName = binding.RoleName
+			bindKind, bindName = roleKind, binding.RoleName
+		}
+
+		err := b.createWithUniqueName(ctx, req.Storage, &walID, entry, &binding.RoleBindingName, roleBindingNamePrefix, func() error {
+			_, err := b.kubernetesService.CreateRoleBinding(ctx, pluginConfig, binding.Namespace, binding.RoleBindingName, sa.Namespace, sa.Name, bindKind, bindName, metadata)
+			return err
+		})
+		if err != nil {
+			b.Logger().Error(fmt.Sprintf("Error setting up Kubernetes role binding for SA %s in namespace: %s: %s", sa.Name, binding.Namespace, err))
+			b.cleanupCredential(ctx, req.Storage, pluginConfig, walID, created)
+			return nil, err
+		}
+		createdBinding.RoleBindingName = binding.RoleBindingName
+	}
 
+	err = putLeaseIndexEntry(ctx, req.Storage, &leaseIndexEntry{
+		Cluster:                cluster,
+		Namespace:              namespace,
+		ServiceAccountName:     sa.Name,
+		Bindings:               entry.Bindings,
+		ClusterRoleBindingName: entry.ClusterRoleBindingName,
+		ExpiresAt:              expiresAt,
+	})
 	if err != nil {
-		b.Logger().Error(fmt.Sprintf("Error setting up Kubernetes role binding for SA %s: %s", sa.Name, err))
-		b.kubernetesService.DeleteServiceAccount(pluginConfig, sa.Namespace, sa.Name)
+		b.Logger().Error(fmt.Sprintf("Error storing lease index entry for SA %s: %s", sa.Name, err))
+		b.cleanupCredential(ctx, req.Storage, pluginConfig, walID, created)
 		return nil, err
 	}
 
-	b.Logger().Info(fmt.Sprintf("Service account '%s' created with rolebinding '%s'", sa.Name, rb.Name))
+	// the credential is complete and will be revoked with its lease, so it must not be rolled back anymore
+	if err := framework.DeleteWAL(ctx, req.Storage, walID); err != nil {
+		b.Logger().Error(fmt.Sprintf("Error removing write-ahead log entry for SA %s: %s", sa.Name, err))
+		b.cleanupCredential(ctx, req.Storage, pluginConfig, walID, created)
+		return nil, err
+	}
 
-	dur, err := time.ParseDuration(fmt.Sprintf("%ds", ttl))
+	if clusterWide {
+		b.Logger().Info(fmt.Sprintf("Service account '%s' created with cluster role binding '%s'", sa.Name, entry.ClusterRoleBindingName))
+	} else {
+		b.Logger().Info(fmt.Sprintf("Service account '%s' created with access to namespaces: %s", sa.Name, strings.Join(targetNamespaces, ", ")))
+	}
+
+	// the role binding in the namespace of the service account is returned as before, the bindings in all namespaces are
+	// kept in the internal data for revocation
+	data := map[string]interface{}{
+		keyCACert:                 token.CACert,
+		keyNamespace:              token.Namespace,
+		keyNamespaces:             targetNamespaces,
+		keyServiceAccountToken:    token.Token,
+		keyServiceAccountName:     sa.Name,
+		keyRoleBindingName:        "",
+		keyClusterRoleBindingName: entry.ClusterRoleBindingName,
+		keyRoleName:               "",
+		keyKubeConfig:             generateKubeConfig(pluginConfig, token.CACert, token.Token, sa.Name, namespace),
+	}
+	for _, binding := range entry.Bindings {
+		if binding.Namespace == namespace {
+			data[keyRoleBindingName] = binding.RoleBindingName
+			data[keyRoleName] = binding.RoleName
+		}
+	}
+
+	resp := b.Secret(secretAccessKeyType).Response(data, map[string]interface{}{
+		keyCluster:  cluster,
+		keyRole:     role.Name,
+		keyBindings: entry.Bindings,
+	})
+
+	// set up TTL for secret so it gets automatically revoked, it can be renewed up to the max ttl
+	resp.Secret.TTL = dur
+	resp.Secret.MaxTTL = time.Duration(getMaxTTL(b.System(), pluginConfig, role)) * time.Second
+	resp.Secret.Renewable = true
+
+	return resp, nil
+}
+
+// maxNameAttempts is how many generated names are tried for an object before creating a credential fails
+const maxNameAttempts = 5
+
+// createWithUniqueName creates an object with the generated name, generating a new name when an object with that name
+// already exists, which belongs to another lease. The write-ahead log entry is replaced before the new name is used, so
+// a rollback never removes the existing object
+func (b *backend) createWithUniqueName(ctx context.Context, s logical.Storage, walID *string, entry *walCredential, name *string, prefix string, create func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := create()
+		if err == nil || !IsAlreadyExists(err) {
+			return err
+		}
+		b.Logger().Warn(fmt.Sprintf("Generated name '%s' is already in use, attempt %d of %d", *name, attempt, maxNameAttempts))
+
+		// the name of the existing object is removed from the write-ahead log entry even when no attempts are left
+		taken := *name
+		*name = ""
+		if attempt < maxNameAttempts {
+			*name = generateName(prefix)
+		}
+		if err := replaceWAL(ctx, s, walID, entry); err != nil {
+			return fmt.Errorf("could not replace generated name '%s' in write-ahead log: %s", taken, err)
+		}
+		if attempt >= maxNameAttempts {
+			return err
+		}
+	}
+}
+
+// replaceWAL replaces a write-ahead log entry with an updated one. The old entry is removed first, objects created in
+// between are left to tidy rather than risking a rollback of the old entry
+func replaceWAL(ctx context.Context, s logical.Storage, walID *string, entry *walCredential) error {
+	if err := framework.DeleteWAL(ctx, s, *walID); err != nil {
+		return err
+	}
+	id, err := framework.PutWAL(ctx, s, walKindCredential, entry)
 	if err != nil {
-		return nil, errwrap.Wrapf(fmt.Sprintf("ttl: %d could not be parse due to error: %s", ttl, err), err)
+		return err
+	}
+	*walID = id
+	return nil
+}
+
+// createToken issues a token for the existing service account of the role in the namespace. Nothing is created in the
+// cluster, so there is nothing to roll back or tidy, and the token stays valid until it expires even if the lease is revoked
+func (b *backend) createToken(ctx context.Context, req *logical.Request, pluginConfig *PluginConfig, cluster string, role *Role, namespace string, ttl int) (*logical.Response, error) {
+	if pluginConfig.LegacyTokenSecret {
+		return logical.ErrorResponse("Role '%s' issues tokens for an existing service account, which requires the TokenRequest API and can not be used when %s is set", role.Name, keyLegacyTokenSecret), nil
+	}
+
+	ttl = getTTL(b.System(), pluginConfig, role, ttl)
+
+	sa, err := b.kubernetesService.GetServiceAccount(ctx, pluginConfig, namespace, role.ServiceAccountName)
+	if err != nil && IsNotFound(err) {
+		return logical.ErrorResponse("Service account '%s' of role '%s' does not exist in namespace: %s", role.ServiceAccountName, role.Name, namespace), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	b.Logger().Info(fmt.Sprintf("creating token with ttl: %d for existing service account '%s' of role: %s in namespace: %s", ttl, sa.Name, role.Name, namespace))
+	token, err := b.kubernetesService.CreateServiceAccountToken(ctx, pluginConfig, sa, ttl)
+	if err != nil {
+		b.Logger().Error(fmt.Sprintf("Error creating token for existing service account '%s': %s", sa.Name, err))
+		return nil, err
 	}
 
 	resp := b.Secret(secretAccessKeyType).Response(map[string]interface{}{
-		keyCACert:              secrets[0].CACert,
-		keyNamespace:           secrets[0].Namespace,
-		keyServiceAccountToken: secrets[0].Token,
+		keyCACert:              token.CACert,
+		keyNamespace:           token.Namespace,
+		keyNamespaces:          []string{namespace},
+		keyServiceAccountToken: token.Token,
 		keyServiceAccountName:  sa.Name,
-		keyRoleBindingName:     rb.Name,
-		keyKubeConfig:          generateKubeConfig(pluginConfig, secrets[0].CACert, secrets[0].Token, sa.Name, namespace),
-	}, map[string]interface{}{})
+		keyKubeConfig:          generateKubeConfig(pluginConfig, token.CACert, token.Token, sa.Name, namespace),
+	}, map[string]interface{}{
+		keyCluster:                cluster,
+		keyRole:                   role.Name,
+		keyExistingServiceAccount: true,
+	})
 
-	// set up TTL for secret so it gets automatically revoked
-	resp.Secret.LeaseOptions.TTL = dur
-	resp.Secret.LeaseOptions.MaxTTL = dur
-	resp.Secret.LeaseOptions.Renewable = false
-	resp.Secret.TTL = dur
-	resp.Secret.MaxTTL = dur
-	resp.Secret.Renewable = false
+	resp.Secret.TTL = time.Duration(ttl) * time.Second
+	resp.Secret.MaxTTL = time.Duration(getMaxTTL(b.System(), pluginConfig, role)) * time.Second
+	resp.Secret.Renewable = true
 
 	return resp, nil
 }
 
-func (b *backend) revokeSecret(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+// getServiceAccountToken retrieves a token for a newly created service account, either by requesting a bound token through the
+// TokenRequest API, or when configured to do so, by reading the legacy token secret generated by the token controller
+func (b *backend) getServiceAccountToken(ctx context.Context, pluginConfig *PluginConfig, sa *ServiceAccountDetails, ttl int) (*ServiceAccountSecret, error) {
+	if !pluginConfig.LegacyTokenSecret {
+		return b.kubernetesService.CreateServiceAccountToken(ctx, pluginConfig, sa, ttl)
+	}
+
+	return b.kubernetesService.GetServiceAccountSecret(ctx, pluginConfig, sa)
+}
+
+func (b *backend) renewSecret(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	cluster, _ := req.Secret.InternalData[keyCluster].(string)
+	roleName, _ := req.Secret.InternalData[keyRole].(string)
+	if roleName == "" {
+		return nil, fmt.Errorf("lease was created before renewals were supported and can not be renewed")
+	}
+
 	// reload plugin config on every call to prevent stale config
-	pluginConfig, err := loadPluginConfig(ctx, req.Storage)
+	pluginConfig, err := loadConfigForCluster(ctx, req.Storage, cluster)
 	if err != nil {
 		return nil, err
 	}
 
-	b.Logger().Info("revoking a service account")
+	role, err := resolveRole(ctx, req.Storage, pluginConfig, roleName)
+	if err != nil {
+		return nil, err
+	}
+
+	defaultTTL := time.Duration(getDefaultTTL(b.System(), pluginConfig, role)) * time.Second
+	maxTTL := time.Duration(getMaxTTL(b.System(), pluginConfig, role)) * time.Second
+	ttl, warnings, err := framework.CalculateTTL(b.System(), req.Secret.Increment, defaultTTL, 0, maxTTL, 0, req.Secret.IssueTime)
+	if err != nil {
+		return nil, err
+	}
+	if ttl <= 0 {
+		return nil, fmt.Errorf("lease has reached the max ttl of role '%s' and can not be renewed", role.Name)
+	}
 
 	namespace := d.Get(keyNamespace).(string)
 	serviceAccountName := d.Get(keyServiceAccountName).(string)
-	roleBindingName := d.Get(keyRoleBindingName).(string)
 
-	b.Logger().Info(fmt.Sprintf("deleting role binding with name: %s in namespace: %s", roleBindingName, namespace))
-	err = b.kubernetesService.DeleteRoleBinding(pluginConfig, namespace, roleBindingName)
+	// vault replaces the data of the lease with the data of the renewal, so all of it is returned
+	data := map[string]interface{}{}
+	for k, v := range req.Data {
+		data[k] = v
+	}
+
+	// bound tokens expire, so a new one is issued for the renewed lease. Legacy tokens do not expire and only the lease
+	// is extended, existing service accounts always use bound tokens
+	existing, _ := req.Secret.InternalData[keyExistingServiceAccount].(bool)
+	if !pluginConfig.LegacyTokenSecret || existing {
+		token, err := b.kubernetesService.CreateServiceAccountToken(ctx, pluginConfig, &ServiceAccountDetails{Namespace: namespace, Name: serviceAccountName}, int(ttl.Seconds()))
+		if err != nil {
+			b.Logger().Error(fmt.Sprintf("Error renewing token for service account '%s': %s", serviceAccountName, err))
+			return nil, err
+		}
+		data[keyServiceAccountToken] = token.Token
+		data[keyKubeConfig] = generateKubeConfig(pluginConfig, token.CACert, token.Token, serviceAccountName, namespace)
+	}
+
+	entry, err := loadLeaseIndexEntry(ctx, req.Storage, cluster, namespace, serviceAccountName)
 	if err != nil {
 		return nil, err
 	}
-	b.Logger().Info(fmt.Sprintf("deleted role binding with name: %s in namespace: %s", roleBindingName, namespace))
+	if entry != nil {
+		entry.ExpiresAt = time.Now().Add(ttl)
+		if err := putLeaseIndexEntry(ctx, req.Storage, entry); err != nil {
+			return nil, err
+		}
+	}
+
+	b.Logger().Info(fmt.Sprintf("renewed service account '%s' in namespace: %s with ttl: %s", serviceAccountName, namespace, ttl))
+
+	resp := &logical.Response{
+		Data:     data,
+		Secret:   req.Secret,
+		Warnings: warnings,
+	}
+	resp.Secret.TTL = ttl
+	resp.Secret.MaxTTL = maxTTL
+	return resp, nil
+}
+
+func (b *backend) revokeSecret(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	namespace := d.Get(keyNamespace).(string)
+	serviceAccountName := d.Get(keyServiceAccountName).(string)
+
+	// bound tokens can not be revoked and the service account is not managed by the plugin, so it is left in place
+	if existing, _ := req.Secret.InternalData[keyExistingServiceAccount].(bool); existing {
+		b.Logger().Info(fmt.Sprintf("revoking token for existing service account '%s' in namespace: %s, the token remains valid until it expires", serviceAccountName, namespace))
+		return nil, nil
+	}
 
-	b.Logger().Info(fmt.Sprintf("deleting service account with name: %s in namespace: %s", serviceAccountName, namespace))
-	err = b.kubernetesService.DeleteServiceAccount(pluginConfig, namespace, serviceAccountName)
+	// leases created before clusters were supported have no cluster and belong to the cluster in the plugin config
+	cluster, _ := req.Secret.InternalData[keyCluster].(string)
+
+	// reload plugin config on every call to prevent stale config
+	pluginConfig, err := loadConfigForCluster(ctx, req.Storage, cluster)
 	if err != nil {
 		return nil, err
 	}
-	b.Logger().Info(fmt.Sprintf("deleted service account with name: %s in namespace: %s", serviceAccountName, namespace))
+
+	b.Logger().Info("revoking a service account")
+
+	clusterRoleBindingName := d.Get(keyClusterRoleBindingName).(string)
+
+	bindings, err := leaseBindings(req.Secret.InternalData)
+	if err != nil {
+		return nil, err
+	}
+	if bindings == nil {
+		// leases created before credentials could span multiple namespaces only have a binding in the namespace of the
+		// service account
+		bindings = []namespaceBinding{{
+			Namespace:       namespace,
+			RoleBindingName: d.Get(keyRoleBindingName).(string),
+			RoleName:        d.Get(keyRoleName).(string),
+		}}
+	}
+
+	// every object is deleted even if an earlier one fails, objects that are already gone count as deleted so the lease
+	// can still be revoked when they were removed by hand
+	var errs []string
+	for _, binding := range bindings {
+		binding := binding
+		if binding.RoleBindingName != "" {
+			err = b.deleteObject(roleBindingKind, binding.Namespace, binding.RoleBindingName, func() error {
+				return b.kubernetesService.DeleteRoleBinding(ctx, pluginConfig, binding.Namespace, binding.RoleBindingName)
+			})
+			if err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+
+		if binding.RoleName != "" {
+			err = b.deleteObject(roleKind, binding.Namespace, binding.RoleName, func() error {
+				return b.kubernetesService.DeleteRole(ctx, pluginConfig, binding.Namespace, binding.RoleName)
+			})
+			if err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+
+	if clusterRoleBindingName != "" {
+		err = b.deleteObject(clusterRoleBindingKind, "", clusterRoleBindingName, func() error {
+			return b.kubernetesService.DeleteClusterRoleBinding(ctx, pluginConfig, clusterRoleBindingName)
+		})
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	err = b.deleteObject(serviceAccountKind, namespace, serviceAccountName, func() error {
+		return b.kubernetesService.DeleteServiceAccount(ctx, pluginConfig, namespace, serviceAccountName)
+	})
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("could not revoke service account '%s': %s", serviceAccountName, strings.Join(errs, "; "))
+	}
+
+	if err := deleteLeaseIndexEntry(ctx, req.Storage, cluster, namespace, serviceAccountName); err != nil {
+		return nil, err
+	}
 
 	resp := b.Secret(secretAccessKeyType).Response(map[string]interface{}{
 		keyServiceAccountName: serviceAccountName,
@@ -159,18 +497,99 @@ func (b *backend) revokeSecret(ctx context.Context, req *logical.Request, d *fra
 	return resp, nil
 }
 
-// getCluterRoleName is a helper function to pull out the correct cluster role from the plugin configuration for the saType
-func getClusterRoleName(pluginConfig *PluginConfig, saType string) (string, error) {
-	switch saType {
-	case "admin":
-		return pluginConfig.AdminRole, nil
-	case "editor":
-		return pluginConfig.EditorRole, nil
-	case "viewer":
-		return pluginConfig.ViewerRole, nil
+// leaseBindings returns the role bindings recorded in the internal data of a lease, or nil for leases created before
+// they were recorded. The internal data is stored as JSON, so the bindings are converted back from maps
+func leaseBindings(internalData map[string]interface{}) ([]namespaceBinding, error) {
+	value, ok := internalData[keyBindings]
+	if !ok || value == nil {
+		return nil, nil
+	}
+
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	bindings := []namespaceBinding{}
+	if err := json.Unmarshal(raw, &bindings); err != nil {
+		return nil, err
+	}
+	return bindings, nil
+}
+
+// deleteObject deletes a Kubernetes object using the delete function, treating an object that does not exist as deleted
+func (b *backend) deleteObject(kind string, namespace string, name string, delete func() error) error {
+	b.Logger().Info(fmt.Sprintf("deleting %s with name: %s in namespace: %s", kind, name, namespace))
+	err := delete()
+	if err != nil && IsNotFound(err) {
+		b.Logger().Warn(fmt.Sprintf("%s with name: %s in namespace: %s was already deleted", kind, name, namespace))
+		return nil
+	}
+	if err != nil {
+		b.Logger().Error(fmt.Sprintf("Error deleting %s with name: %s in namespace: %s: %s", kind, name, namespace, err))
+		return err
+	}
+	b.Logger().Info(fmt.Sprintf("deleted %s with name: %s in namespace: %s", kind, name, namespace))
+	return nil
+}
+
+// objectMetadata returns the labels and annotations that trace the Kubernetes objects created for a credential back to
+// the vault request. Vault generates the lease id after the response is returned and removes it from renew requests, so
+// a hash of it can not be annotated. The request id is recorded in the vault audit log together with the lease id instead
+func objectMetadata(req *logical.Request, role *Role, expiresAt time.Time) *ObjectMetadata {
+	return &ObjectMetadata{
+		Labels: map[string]string{
+			labelManagedBy:     managedByValue,
+			labelMountAccessor: labelValue(req.MountAccessor),
+			labelRole:          labelValue(role.Name),
+		},
+		Annotations: map[string]string{
+			annotationEntityID:    req.EntityID,
+			annotationDisplayName: req.DisplayName,
+			annotationRequestID:   req.ID,
+			annotationExpiresAt:   expiresAt.UTC().Format(time.RFC3339),
+		},
+	}
+}
+
+// getTTL is a helper function to work out the ttl for a new secret, applying the defaults and limits from the role, the plugin
+// configuration and the mount. The ttl is the one vault applies to the lease, so the token can be requested for it
+func getTTL(sys logical.SystemView, pluginConfig *PluginConfig, role *Role, ttl int) int {
+	maxTTL := getMaxTTL(sys, pluginConfig, role)
+
+	if ttl <= 0 {
+		ttl = getDefaultTTL(sys, pluginConfig, role)
+	}
+
+	if ttl > maxTTL {
+		ttl = maxTTL
 	}
 
-	return "", fmt.Errorf("Service Account type '%s' is not a valid type", saType)
+	return ttl
+}
+
+// getDefaultTTL is a helper function to work out the default ttl of the role, falling back to the plugin configuration and
+// the default lease ttl of the mount
+func getDefaultTTL(sys logical.SystemView, pluginConfig *PluginConfig, role *Role) int {
+	if role.DefaultTTL > 0 {
+		return role.DefaultTTL
+	}
+	if pluginConfig.DefaulTTL > 0 {
+		return pluginConfig.DefaulTTL
+	}
+	return int(sys.DefaultLeaseTTL().Seconds())
+}
+
+// getMaxTTL is a helper function to work out the max ttl of the role, which can not exceed the max ttl of the plugin configuration
+// when it has one, nor the max lease ttl of the mount
+func getMaxTTL(sys logical.SystemView, pluginConfig *PluginConfig, role *Role) int {
+	maxTTL := int(sys.MaxLeaseTTL().Seconds())
+	if pluginConfig.MaxTTL > 0 && pluginConfig.MaxTTL < maxTTL {
+		maxTTL = pluginConfig.MaxTTL
+	}
+	if role.MaxTTL > 0 && role.MaxTTL < maxTTL {
+		maxTTL = role.MaxTTL
+	}
+	return maxTTL
 }
 
 func generateKubeConfig(pluginConfig *PluginConfig, caCert string, token string, name string, namespace string) string {
@@ -192,7 +611,7 @@ preferences: {}
 users:
 - name: %s
   user:
-    token: %s`, base64Encode(caCert), pluginConfig.Host, name, name, namespace, name, name, name, name, token)
+    token: %s`, base64Encode(caCert), clusterHost(pluginConfig), name, name, namespace, name, name, name, name, token)
 }
 
 func base64Encode(s string) string {
@@ -0,0 +1,47 @@
+package servian
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestGetTTL(t *testing.T) {
+	sys := &logical.StaticSystemView{
+		DefaultLeaseTTLVal: 768 * time.Hour,
+		MaxLeaseTTLVal:     2 * 768 * time.Hour,
+	}
+	mountDefault := int((768 * time.Hour).Seconds())
+	mountMax := int((2 * 768 * time.Hour).Seconds())
+
+	tests := []struct {
+		name        string
+		config      PluginConfig
+		role        Role
+		ttl         int
+		expected    int
+		expectedMax int
+	}{
+		{name: "config defaults", config: PluginConfig{DefaulTTL: 600, MaxTTL: 3600}, expected: 600, expectedMax: 3600},
+		{name: "requested ttl", config: PluginConfig{DefaulTTL: 600, MaxTTL: 3600}, ttl: 1800, expected: 1800, expectedMax: 3600},
+		{name: "requested ttl above the config max", config: PluginConfig{DefaulTTL: 600, MaxTTL: 3600}, ttl: 7200, expected: 3600, expectedMax: 3600},
+		{name: "role defaults", config: PluginConfig{DefaulTTL: 600, MaxTTL: 3600}, role: Role{DefaultTTL: 300, MaxTTL: 900}, expected: 300, expectedMax: 900},
+		{name: "role max above the config max", config: PluginConfig{DefaulTTL: 600, MaxTTL: 3600}, role: Role{MaxTTL: 7200}, ttl: 7200, expected: 3600, expectedMax: 3600},
+		{name: "role max without a config max", config: PluginConfig{DefaulTTL: 600}, role: Role{MaxTTL: 900}, ttl: 7200, expected: 900, expectedMax: 900},
+		{name: "mount defaults without a config ttl", config: PluginConfig{}, expected: mountDefault, expectedMax: mountMax},
+		{name: "mount max without a config max", config: PluginConfig{DefaulTTL: 600}, ttl: 2 * mountMax, expected: mountMax, expectedMax: mountMax},
+		{name: "config max above the mount max", config: PluginConfig{MaxTTL: 2 * mountMax}, ttl: 2 * mountMax, expected: mountMax, expectedMax: mountMax},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if ttl := getTTL(sys, &tt.config, &tt.role, tt.ttl); ttl != tt.expected {
+				t.Errorf("expected ttl %d, got %d", tt.expected, ttl)
+			}
+			if maxTTL := getMaxTTL(sys, &tt.config, &tt.role); maxTTL != tt.expectedMax {
+				t.Errorf("expected max ttl %d, got %d", tt.expectedMax, maxTTL)
+			}
+		})
+	}
+}
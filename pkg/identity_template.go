@@ -0,0 +1,124 @@
+package servian
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// identityTemplateRegex matches the identity parameters in a namespace pattern, e.g. {{identity.entity.metadata.team}}
+var identityTemplateRegex = regexp.MustCompile(`{{\s*([^{}]*?)\s*}}`)
+
+// globEscaper escapes the characters with a special meaning in path.Match, so values from the identity of a request
+// are always matched literally
+var globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`)
+
+// hasIdentityTemplate checks if any of the patterns contains identity parameters
+func hasIdentityTemplate(patterns ...[]string) bool {
+	for _, list := range patterns {
+		for _, pattern := range list {
+			if identityTemplateRegex.MatchString(pattern) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// renderIdentityTemplate replaces the identity parameters in a pattern with the values of the entity, supporting the same
+// entity parameters as vault policy templates. It fails when the entity does not have a value for a parameter, so a pattern
+// is never widened by an empty value
+func renderIdentityTemplate(pattern string, entity *logical.Entity) (string, error) {
+	var renderErr error
+	rendered := identityTemplateRegex.ReplaceAllStringFunc(pattern, func(match string) string {
+		parameter := identityTemplateRegex.FindStringSubmatch(match)[1]
+		value, err := identityParameter(parameter, entity)
+		if err != nil && renderErr == nil {
+			renderErr = err
+		}
+		return globEscaper.Replace(value)
+	})
+	if renderErr != nil {
+		return "", renderErr
+	}
+	return rendered, nil
+}
+
+// validateIdentityTemplate checks that all identity parameters in a pattern are supported
+func validateIdentityTemplate(pattern string) error {
+	for _, match := range identityTemplateRegex.FindAllStringSubmatch(pattern, -1) {
+		if _, err := identityParameter(match[1], nil); err != nil && !isMissingIdentityValue(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// missingIdentityValue is returned when a supported parameter has no value for the entity of the request
+type missingIdentityValue struct {
+	parameter string
+}
+
+func (e *missingIdentityValue) Error() string {
+	return fmt.Sprintf("'%s' has no value for the entity of the request", e.parameter)
+}
+
+func isMissingIdentityValue(err error) bool {
+	_, ok := err.(*missingIdentityValue)
+	return ok
+}
+
+// identityParameter returns the value of an identity parameter for the entity, the parameter is validated even if there
+// is no entity
+func identityParameter(parameter string, entity *logical.Entity) (string, error) {
+	parts := strings.Split(parameter, ".")
+	if len(parts) < 3 || parts[0] != "identity" || parts[1] != "entity" {
+		return "", fmt.Errorf("unsupported identity parameter '%s', only identity.entity parameters are supported", parameter)
+	}
+
+	value := ""
+	switch {
+	case len(parts) == 3 && parts[2] == "id":
+		if entity != nil {
+			value = entity.ID
+		}
+	case len(parts) == 3 && parts[2] == "name":
+		if entity != nil {
+			value = entity.Name
+		}
+	case len(parts) == 4 && parts[2] == "metadata":
+		if entity != nil {
+			value = entity.Metadata[parts[3]]
+		}
+	case len(parts) == 5 && parts[2] == "aliases" && parts[4] == "name":
+		if alias := entityAlias(entity, parts[3]); alias != nil {
+			value = alias.Name
+		}
+	case len(parts) == 6 && parts[2] == "aliases" && parts[4] == "metadata":
+		if alias := entityAlias(entity, parts[3]); alias != nil {
+			value = alias.Metadata[parts[5]]
+		}
+	default:
+		return "", fmt.Errorf("unsupported identity parameter '%s'", parameter)
+	}
+
+	if value == "" {
+		return "", &missingIdentityValue{parameter: parameter}
+	}
+	return value, nil
+}
+
+// entityAlias returns the alias of the entity for the auth mount with the accessor
+func entityAlias(entity *logical.Entity, mountAccessor string) *logical.Alias {
+	if entity == nil {
+		return nil
+	}
+	for _, alias := range entity.Aliases {
+		if alias.MountAccessor == mountAccessor {
+			return alias
+		}
+	}
+	return nil
+}
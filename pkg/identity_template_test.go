@@ -0,0 +1,106 @@
+package servian
+
+import (
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func testEntity() *logical.Entity {
+	return &logical.Entity{
+		ID:   "entity-id",
+		Name: "alice",
+		Metadata: map[string]string{
+			"team": "payments",
+			"glob": "a*b?[c]\\",
+		},
+		Aliases: []*logical.Alias{
+			{
+				MountAccessor: "auth_oidc_1234",
+				Name:          "alice@example.com",
+				Metadata: map[string]string{
+					"group": "ops",
+				},
+			},
+		},
+	}
+}
+
+func TestRenderIdentityTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		pattern  string
+		entity   *logical.Entity
+		expected string
+		wantErr  bool
+	}{
+		{name: "no parameters", pattern: "team-*", entity: testEntity(), expected: "team-*"},
+		{name: "entity id", pattern: "{{identity.entity.id}}", entity: testEntity(), expected: "entity-id"},
+		{name: "entity name", pattern: "user-{{identity.entity.name}}", entity: testEntity(), expected: "user-alice"},
+		{name: "metadata", pattern: "{{identity.entity.metadata.team}}-*", entity: testEntity(), expected: "payments-*"},
+		{name: "spaces inside the braces", pattern: "{{ identity.entity.metadata.team }}-*", entity: testEntity(), expected: "payments-*"},
+		{name: "alias name", pattern: "{{identity.entity.aliases.auth_oidc_1234.name}}", entity: testEntity(), expected: "alice@example.com"},
+		{name: "alias metadata", pattern: "{{identity.entity.aliases.auth_oidc_1234.metadata.group}}", entity: testEntity(), expected: "ops"},
+		{name: "glob characters in values are escaped", pattern: "{{identity.entity.metadata.glob}}", entity: testEntity(), expected: `a\*b\?\[c]\\`},
+		{name: "several parameters", pattern: "{{identity.entity.metadata.team}}-{{identity.entity.name}}", entity: testEntity(), expected: "payments-alice"},
+		{name: "missing metadata", pattern: "{{identity.entity.metadata.unknown}}-*", entity: testEntity(), wantErr: true},
+		{name: "unknown alias mount", pattern: "{{identity.entity.aliases.auth_other.name}}", entity: testEntity(), wantErr: true},
+		{name: "no entity", pattern: "{{identity.entity.name}}", entity: nil, wantErr: true},
+		{name: "unsupported parameter", pattern: "{{identity.groups.names}}", entity: testEntity(), wantErr: true},
+		{name: "unsupported entity parameter", pattern: "{{identity.entity.email}}", entity: testEntity(), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rendered, err := renderIdentityTemplate(tt.pattern, tt.entity)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got '%s'", rendered)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if rendered != tt.expected {
+				t.Errorf("expected '%s', got '%s'", tt.expected, rendered)
+			}
+		})
+	}
+}
+
+func TestValidateIdentityTemplate(t *testing.T) {
+	tests := []struct {
+		pattern string
+		wantErr bool
+	}{
+		{pattern: "team-*"},
+		{pattern: "{{identity.entity.id}}"},
+		{pattern: "{{identity.entity.metadata.team}}-*"},
+		{pattern: "{{identity.entity.aliases.auth_oidc_1234.metadata.group}}"},
+		{pattern: "{{identity.entity.metadata}}", wantErr: true},
+		{pattern: "{{identity.groups.names}}", wantErr: true},
+		{pattern: "{{token.display_name}}", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			err := validateIdentityTemplate(tt.pattern)
+			if tt.wantErr && err == nil {
+				t.Fatal("expected an error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		})
+	}
+}
+
+func TestHasIdentityTemplate(t *testing.T) {
+	if hasIdentityTemplate([]string{"team-*"}, nil) {
+		t.Error("expected patterns without parameters to have no identity template")
+	}
+	if !hasIdentityTemplate([]string{"team-*"}, []string{"{{identity.entity.name}}"}) {
+		t.Error("expected a pattern with a parameter to have an identity template")
+	}
+}
@@ -22,5 +22,5 @@ func invalidPath(b *backend) *framework.Path {
 
 // gives the user a nicer error message than the normal "No value found at .../service_account"
 func (b *backend) handleInvalidPath(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	return nil, fmt.Errorf("Invalid path, make sure the service account type is appended to the path, e.g. 'service_account/viewer'")
+	return nil, fmt.Errorf("Invalid path, make sure the namespace and role are appended to the path, e.g. 'service_account/default/viewer'")
 }
@@ -0,0 +1,56 @@
+package servian
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const serviceAccountSubjectPrefix = "system:serviceaccount:"
+
+// jwtClaims contains the claims of a service account token that are useful to identify it
+type jwtClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	ExpiresAt int64  `json:"exp"`
+
+	// SecretName is only set for legacy tokens read from a service account token secret
+	SecretName string `json:"kubernetes.io/serviceaccount/secret.name"`
+}
+
+// parseJWTClaims decodes the claims of a JWT without validating its signature
+func parseJWTClaims(token string) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("token is not a JWT, expected 3 parts but found %d", len(parts))
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, fmt.Errorf("could not decode JWT payload: %s", err)
+	}
+
+	claims := &jwtClaims{}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, fmt.Errorf("could not parse JWT claims: %s", err)
+	}
+	return claims, nil
+}
+
+// serviceAccount returns the namespace and name of the service account the token belongs to
+func (c *jwtClaims) serviceAccount() (string, string, error) {
+	parts := strings.Split(strings.TrimPrefix(c.Subject, serviceAccountSubjectPrefix), ":")
+	if !strings.HasPrefix(c.Subject, serviceAccountSubjectPrefix) || len(parts) != 2 {
+		return "", "", fmt.Errorf("token subject '%s' is not a service account", c.Subject)
+	}
+	return parts[0], parts[1], nil
+}
+
+// fingerprint returns a SHA256 fingerprint of a secret value, so it can be identified without being exposed
+func fingerprint(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,108 @@
+package servian
+
+import (
+	"fmt"
+
+	clientcmdv1 "k8s.io/client-go/tools/clientcmd/api/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const keyKubeConfigDocument = "kubeconfig"
+const keyKubeConfigContext = "kubeconfig_context"
+
+// kubeConfigConnection contains the connection settings read from a context of a kubeconfig
+type kubeConfigConnection struct {
+	Host       string
+	CACert     string
+	Token      string
+	ClientCert string
+	ClientKey  string
+}
+
+// parseKubeConfig reads the connection settings of a context from a kubeconfig in YAML or JSON, using the current context
+// when no context is given. Only settings embedded in the kubeconfig are supported, kubeconfigs that reference local
+// files, run plugins or use basic auth or impersonation are rejected
+func parseKubeConfig(kubeConfig string, contextName string) (*kubeConfigConnection, error) {
+	config := clientcmdv1.Config{}
+	if err := yaml.Unmarshal([]byte(kubeConfig), &config); err != nil {
+		return nil, fmt.Errorf("could not parse kubeconfig: %s", err)
+	}
+
+	if contextName == "" {
+		contextName = config.CurrentContext
+	}
+	if contextName == "" {
+		return nil, fmt.Errorf("kubeconfig has no current-context, set %s to choose one", keyKubeConfigContext)
+	}
+
+	var context *clientcmdv1.Context
+	for i := range config.Contexts {
+		if config.Contexts[i].Name == contextName {
+			context = &config.Contexts[i].Context
+			break
+		}
+	}
+	if context == nil {
+		return nil, fmt.Errorf("kubeconfig has no context '%s'", contextName)
+	}
+
+	var cluster *clientcmdv1.Cluster
+	for i := range config.Clusters {
+		if config.Clusters[i].Name == context.Cluster {
+			cluster = &config.Clusters[i].Cluster
+			break
+		}
+	}
+	if cluster == nil {
+		return nil, fmt.Errorf("kubeconfig has no cluster '%s' for context '%s'", context.Cluster, contextName)
+	}
+
+	var user *clientcmdv1.AuthInfo
+	for i := range config.AuthInfos {
+		if config.AuthInfos[i].Name == context.AuthInfo {
+			user = &config.AuthInfos[i].AuthInfo
+			break
+		}
+	}
+	if user == nil {
+		return nil, fmt.Errorf("kubeconfig has no user '%s' for context '%s'", context.AuthInfo, contextName)
+	}
+
+	switch {
+	case cluster.Server == "":
+		return nil, fmt.Errorf("cluster '%s' in kubeconfig has no server", context.Cluster)
+	case cluster.InsecureSkipTLSVerify:
+		return nil, fmt.Errorf("cluster '%s' in kubeconfig skips TLS verification, which is not supported", context.Cluster)
+	case cluster.CertificateAuthority != "":
+		return nil, fmt.Errorf("cluster '%s' in kubeconfig references a certificate-authority file, embed it as certificate-authority-data instead", context.Cluster)
+	case len(cluster.CertificateAuthorityData) == 0:
+		return nil, fmt.Errorf("cluster '%s' in kubeconfig has no certificate-authority-data", context.Cluster)
+	}
+
+	switch {
+	case user.Exec != nil:
+		return nil, fmt.Errorf("user '%s' in kubeconfig runs an exec plugin, which is not supported", context.AuthInfo)
+	case user.AuthProvider != nil:
+		return nil, fmt.Errorf("user '%s' in kubeconfig uses the auth provider '%s', which is not supported", context.AuthInfo, user.AuthProvider.Name)
+	case user.TokenFile != "" || user.ClientCertificate != "" || user.ClientKey != "":
+		return nil, fmt.Errorf("user '%s' in kubeconfig references local files, embed them as token, client-certificate-data and client-key-data instead", context.AuthInfo)
+	case user.Username != "" || user.Password != "":
+		return nil, fmt.Errorf("user '%s' in kubeconfig uses basic auth, which is not supported", context.AuthInfo)
+	case user.Impersonate != "" || len(user.ImpersonateGroups) > 0 || len(user.ImpersonateUserExtra) > 0:
+		return nil, fmt.Errorf("user '%s' in kubeconfig uses impersonation, which is not supported", context.AuthInfo)
+	case len(user.ClientCertificateData) > 0 != (len(user.ClientKeyData) > 0):
+		return nil, fmt.Errorf("user '%s' in kubeconfig needs both client-certificate-data and client-key-data", context.AuthInfo)
+	case user.Token != "" && len(user.ClientCertificateData) > 0:
+		return nil, fmt.Errorf("user '%s' in kubeconfig has both a token and a client certificate, only one can be used", context.AuthInfo)
+	case user.Token == "" && len(user.ClientCertificateData) == 0:
+		return nil, fmt.Errorf("user '%s' in kubeconfig has no token or client certificate", context.AuthInfo)
+	}
+
+	return &kubeConfigConnection{
+		Host:       cluster.Server,
+		CACert:     string(cluster.CertificateAuthorityData),
+		Token:      user.Token,
+		ClientCert: string(user.ClientCertificateData),
+		ClientKey:  string(user.ClientKeyData),
+	}, nil
+}
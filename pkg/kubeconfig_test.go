@@ -0,0 +1,115 @@
+package servian
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+var testCAData = base64.StdEncoding.EncodeToString([]byte("ca cert"))
+var testCertData = base64.StdEncoding.EncodeToString([]byte("client cert"))
+var testKeyData = base64.StdEncoding.EncodeToString([]byte("client key"))
+
+// testKubeConfig returns a kubeconfig with the cluster and user settings of its current context replaced
+func testKubeConfig(cluster string, user string) string {
+	return fmt.Sprintf(`apiVersion: v1
+kind: Config
+current-context: dev
+contexts:
+- name: dev
+  context:
+    cluster: dev-cluster
+    user: dev-user
+- name: prod
+  context:
+    cluster: prod-cluster
+    user: prod-user
+clusters:
+- name: dev-cluster
+  cluster:
+%s
+- name: prod-cluster
+  cluster:
+    server: https://prod.example.com
+    certificate-authority-data: %s
+users:
+- name: dev-user
+  user:
+%s
+- name: prod-user
+  user:
+    client-certificate-data: %s
+    client-key-data: %s
+`, indent(cluster), testCAData, indent(user), testCertData, testKeyData)
+}
+
+func indent(settings string) string {
+	lines := strings.Split(strings.TrimSpace(settings), "\n")
+	for i := range lines {
+		lines[i] = "    " + lines[i]
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestParseKubeConfig(t *testing.T) {
+	validCluster := "server: https://dev.example.com\ncertificate-authority-data: " + testCAData
+	validUser := "token: dev-token"
+
+	tests := []struct {
+		name       string
+		kubeConfig string
+		context    string
+		expected   *kubeConfigConnection
+		wantErr    string
+	}{
+		{
+			name:       "current context with a token",
+			kubeConfig: testKubeConfig(validCluster, validUser),
+			expected:   &kubeConfigConnection{Host: "https://dev.example.com", CACert: "ca cert", Token: "dev-token"},
+		},
+		{
+			name:       "named context with a client certificate",
+			kubeConfig: testKubeConfig(validCluster, validUser),
+			context:    "prod",
+			expected:   &kubeConfigConnection{Host: "https://prod.example.com", CACert: "ca cert", ClientCert: "client cert", ClientKey: "client key"},
+		},
+		{name: "not a kubeconfig", kubeConfig: "clusters: [", wantErr: "could not parse kubeconfig"},
+		{name: "no current context", kubeConfig: strings.Replace(testKubeConfig(validCluster, validUser), "current-context: dev", "", 1), wantErr: "no current-context"},
+		{name: "unknown context", kubeConfig: testKubeConfig(validCluster, validUser), context: "staging", wantErr: "no context 'staging'"},
+		{name: "no server", kubeConfig: testKubeConfig("certificate-authority-data: "+testCAData, validUser), wantErr: "has no server"},
+		{name: "insecure", kubeConfig: testKubeConfig(validCluster+"\ninsecure-skip-tls-verify: true", validUser), wantErr: "skips TLS verification"},
+		{name: "certificate authority file", kubeConfig: testKubeConfig("server: https://dev.example.com\ncertificate-authority: /etc/ca.crt", validUser), wantErr: "certificate-authority file"},
+		{name: "no certificate authority", kubeConfig: testKubeConfig("server: https://dev.example.com", validUser), wantErr: "no certificate-authority-data"},
+		{name: "exec plugin", kubeConfig: testKubeConfig(validCluster, "exec:\n  apiVersion: client.authentication.k8s.io/v1beta1\n  command: aws"), wantErr: "exec plugin"},
+		{name: "auth provider", kubeConfig: testKubeConfig(validCluster, "auth-provider:\n  name: gcp"), wantErr: "auth provider 'gcp'"},
+		{name: "token file", kubeConfig: testKubeConfig(validCluster, "tokenFile: /var/token"), wantErr: "references local files"},
+		{name: "client certificate file", kubeConfig: testKubeConfig(validCluster, "client-certificate: /etc/client.crt\nclient-key: /etc/client.key"), wantErr: "references local files"},
+		{name: "basic auth", kubeConfig: testKubeConfig(validCluster, "username: admin\npassword: secret"), wantErr: "basic auth"},
+		{name: "impersonation", kubeConfig: testKubeConfig(validCluster, "token: dev-token\nas: system:admin"), wantErr: "impersonation"},
+		{name: "certificate without key", kubeConfig: testKubeConfig(validCluster, "client-certificate-data: "+testCertData), wantErr: "needs both"},
+		{name: "token and certificate", kubeConfig: testKubeConfig(validCluster, "token: dev-token\nclient-certificate-data: "+testCertData+"\nclient-key-data: "+testKeyData), wantErr: "only one can be used"},
+		{name: "no credentials", kubeConfig: testKubeConfig(validCluster, "{}"), wantErr: "no token or client certificate"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			connection, err := parseKubeConfig(tt.kubeConfig, tt.context)
+			if tt.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected an error containing '%s'", tt.wantErr)
+				}
+				if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing '%s', got '%s'", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if *connection != *tt.expected {
+				t.Errorf("expected %+v, got %+v", *tt.expected, *connection)
+			}
+		})
+	}
+}
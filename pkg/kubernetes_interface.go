@@ -1,21 +1,77 @@
 package servian
 
+import (
+	"context"
+	"time"
+)
+
 // KubernetesInterface defines the core functions for the Kubernetes integration
 type KubernetesInterface interface {
 	// CreateServiceAccount creates a new service account
-	CreateServiceAccount(pluginConfig *PluginConfig, namespace string) (*ServiceAccountDetails, error)
+	CreateServiceAccount(ctx context.Context, pluginConfig *PluginConfig, namespace string, serviceAccountName string, metadata *ObjectMetadata) (*ServiceAccountDetails, error)
+
+	// GetServiceAccountSecret waits for the token secret of a newly created service account to be populated and returns it
+	GetServiceAccountSecret(ctx context.Context, pluginConfig *PluginConfig, sa *ServiceAccountDetails) (*ServiceAccountSecret, error)
 
-	// GetServiceAccountSecret retrieves the secrets for a newly created service account
-	GetServiceAccountSecret(pluginConfig *PluginConfig, sa *ServiceAccountDetails) ([]*ServiceAccountSecret, error)
+	// CreateServiceAccountToken requests a bound token for a service account using the TokenRequest API
+	CreateServiceAccountToken(ctx context.Context, pluginConfig *PluginConfig, sa *ServiceAccountDetails, ttl int) (*ServiceAccountSecret, error)
+
+	// GetServiceAccount retrieves an existing service account
+	GetServiceAccount(ctx context.Context, pluginConfig *PluginConfig, namespace string, serviceAccountName string) (*ServiceAccountDetails, error)
 
 	// DeleteServiceAccount removes a services account from the Kubernetes server
-	DeleteServiceAccount(pluginConfig *PluginConfig, namespace string, serviceAccountName string) error
+	DeleteServiceAccount(ctx context.Context, pluginConfig *PluginConfig, namespace string, serviceAccountName string) error
+
+	// ListServiceAccounts lists the service accounts in all namespaces with a name starting with the prefix and labels matching the selector
+	ListServiceAccounts(ctx context.Context, pluginConfig *PluginConfig, prefix string, labelSelector string) ([]*ServiceAccountDetails, error)
+
+	// GetNamespace retrieves an existing namespace
+	GetNamespace(ctx context.Context, pluginConfig *PluginConfig, namespace string) (*NamespaceDetails, error)
+
+	// DeleteSecret removes a secret, used to invalidate legacy service account tokens
+	DeleteSecret(ctx context.Context, pluginConfig *PluginConfig, namespace string, secretName string) error
+
+	// CreateRole creates a new role in a specific namespace with rules in YAML or JSON
+	CreateRole(ctx context.Context, pluginConfig *PluginConfig, namespace string, roleName string, rules string, metadata *ObjectMetadata) (*RoleDetails, error)
+
+	// DeleteRole removes an existing role
+	DeleteRole(ctx context.Context, pluginConfig *PluginConfig, namespace string, roleName string) error
 
-	// CreateRoleBinding creates a new rolebinding for a service account in a specific namespace
-	CreateRoleBinding(pluginConfig *PluginConfig, namespace string, serviceAccountName string, roleName string) (*RoleBindingDetails, error)
+	// ListRoles lists the roles in all namespaces with a name starting with the prefix and labels matching the selector
+	ListRoles(ctx context.Context, pluginConfig *PluginConfig, prefix string, labelSelector string) ([]*RoleDetails, error)
+
+	// GetClusterRole retrieves an existing cluster role, the namespace of the returned details is empty
+	GetClusterRole(ctx context.Context, pluginConfig *PluginConfig, clusterRoleName string) (*RoleDetails, error)
+
+	// CreateRoleBinding creates a new rolebinding in a specific namespace for a service account in its own namespace, binding either a Role or a ClusterRole
+	CreateRoleBinding(ctx context.Context, pluginConfig *PluginConfig, namespace string, roleBindingName string, serviceAccountNamespace string, serviceAccountName string, roleKind string, roleName string, metadata *ObjectMetadata) (*RoleBindingDetails, error)
 
 	// DeleteRoleBinding removes an existing role binding
-	DeleteRoleBinding(pluginConfig *PluginConfig, namespace string, roleBindingName string) error
+	DeleteRoleBinding(ctx context.Context, pluginConfig *PluginConfig, namespace string, roleBindingName string) error
+
+	// ListRoleBindings lists the role bindings in all namespaces with a name starting with the prefix and labels matching the selector
+	ListRoleBindings(ctx context.Context, pluginConfig *PluginConfig, prefix string, labelSelector string) ([]*RoleBindingDetails, error)
+
+	// CreateClusterRoleBinding creates a new cluster role binding for a service account, granting a ClusterRole in all namespaces
+	CreateClusterRoleBinding(ctx context.Context, pluginConfig *PluginConfig, clusterRoleBindingName string, namespace string, serviceAccountName string, clusterRoleName string, metadata *ObjectMetadata) (*RoleBindingDetails, error)
+
+	// DeleteClusterRoleBinding removes an existing cluster role binding
+	DeleteClusterRoleBinding(ctx context.Context, pluginConfig *PluginConfig, clusterRoleBindingName string) error
+
+	// ListClusterRoleBindings lists the cluster role bindings with a name starting with the prefix and labels matching the selector
+	ListClusterRoleBindings(ctx context.Context, pluginConfig *PluginConfig, prefix string, labelSelector string) ([]*RoleBindingDetails, error)
+
+	// CheckAccess asks the Kubernetes API if the plugin is allowed to perform an action, in all namespaces when the namespace is empty
+	CheckAccess(ctx context.Context, pluginConfig *PluginConfig, namespace string, verb string, group string, resource string, subresource string) (*AccessReviewDetails, error)
+
+	// ResetClients removes all cached clients, so new clients are created with the current configuration
+	ResetClients()
+}
+
+// ObjectMetadata contains the labels and annotations added to created objects
+type ObjectMetadata struct {
+	Labels      map[string]string
+	Annotations map[string]string
 }
 
 // ServiceAccountDetails contains the details for a service account
@@ -23,13 +79,44 @@ type ServiceAccountDetails struct {
 	Namespace string
 	UID       string
 	Name      string
+	CreatedAt time.Time
+}
+
+// NamespaceDetails contains the details of a Namespace
+type NamespaceDetails struct {
+	UID    string
+	Name   string
+	Labels map[string]string
+}
+
+// RoleDetails contains the details of a Role or ClusterRole, the namespace of a ClusterRole is empty
+type RoleDetails struct {
+	Namespace string
+	UID       string
+	Name      string
+	CreatedAt time.Time
 }
 
-// RoleBindingDetails contains the details of a RoleBinding
+// RoleBindingDetails contains the details of a RoleBinding or ClusterRoleBinding, the namespace of a ClusterRoleBinding is empty
 type RoleBindingDetails struct {
 	Namespace string
 	UID       string
 	Name      string
+	CreatedAt time.Time
+
+	// ServiceAccountNamespace and ServiceAccountName are the first service account the role binding is bound to
+	ServiceAccountNamespace string
+	ServiceAccountName      string
+
+	// RoleKind and RoleName reference the Role or ClusterRole that is bound
+	RoleKind string
+	RoleName string
+}
+
+// AccessReviewDetails contains the result of an access review
+type AccessReviewDetails struct {
+	Allowed bool
+	Reason  string
 }
 
 // ServiceAccountSecret contain the secrets for a service account
@@ -37,4 +124,5 @@ type ServiceAccountSecret struct {
 	CACert    string
 	Namespace string
 	Token     string
+	ExpiresAt time.Time
 }
@@ -1,41 +1,87 @@
 package servian
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	authv1 "k8s.io/api/authentication/v1"
+	authzv1 "k8s.io/api/authorization/v1"
 	v1 "k8s.io/api/core/v1"
 	rbac "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"sigs.k8s.io/yaml"
 )
 
 const serviceAccountNamePrefix = "vault-sa-"
 const roleNamePrefix = "vault-r-"
 const roleBindingNamePrefix = "vault-rb-"
+const clusterRoleBindingNamePrefix = "vault-crb-"
+
+// defaultTokenTimeout is used for configs stored before token_timeout existed
+const defaultTokenTimeout = 10 * time.Second
+const tokenPollInitialInterval = 100 * time.Millisecond
+const tokenPollMaxInterval = 2 * time.Second
+
+// minTokenExpirationSeconds is the shortest expiration the Kubernetes API server accepts for a TokenRequest
+const minTokenExpirationSeconds = 600
+
+const labelManagedBy = "app.kubernetes.io/managed-by"
+const labelMountAccessor = "vault.servian.com/mount-accessor"
+const labelRole = "vault.servian.com/role"
+const annotationEntityID = "vault.servian.com/entity-id"
+const annotationDisplayName = "vault.servian.com/display-name"
+const annotationRequestID = "vault.servian.com/request-id"
+const annotationExpiresAt = "vault.servian.com/expires-at"
+
+const managedByValue = "vault-k8s-secret-engine"
+
+// inClusterCACertFile is the CA certificate of the cluster mounted into every pod, next to the token of its service account
+const inClusterCACertFile = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
 
 const serviceAccountKind = "ServiceAccount"
 const roleKind = "Role"
+const clusterRoleKind = "ClusterRole"
+const roleBindingKind = "RoleBinding"
+const clusterRoleBindingKind = "ClusterRoleBinding"
 
-// KubernetesService is an empty struct to wrap the Kubernetes service functions
-type KubernetesService struct{}
+// KubernetesService wraps the Kubernetes service functions and caches the clients used to call the Kubernetes API
+type KubernetesService struct {
+	clientsLock sync.RWMutex
+	clients     map[string]*kubernetes.Clientset
+}
 
 // CreateServiceAccount creates a new service account
-func (k *KubernetesService) CreateServiceAccount(pluginConfig *PluginConfig, namespace string) (*ServiceAccountDetails, error) {
-	clientSet, err := getClientSet(pluginConfig)
+func (k *KubernetesService) CreateServiceAccount(ctx context.Context, pluginConfig *PluginConfig, namespace string, serviceAccountName string, metadata *ObjectMetadata) (*ServiceAccountDetails, error) {
+	clientSet, err := k.getClientSet(pluginConfig)
 	if err != nil {
 		return nil, err
 	}
+	ctx, cancel := requestContext(ctx, pluginConfig)
+	defer cancel()
+
 	sa := v1.ServiceAccount{
 		TypeMeta: metav1.TypeMeta{},
 		ObjectMeta: metav1.ObjectMeta{
-			GenerateName: serviceAccountNamePrefix,
-			Namespace:    namespace,
+			Name:        serviceAccountName,
+			Namespace:   namespace,
+			Labels:      metadata.Labels,
+			Annotations: metadata.Annotations,
 		},
 	}
-	sar, err := clientSet.CoreV1().ServiceAccounts(namespace).Create(&sa)
+	sar, err := clientSet.CoreV1().ServiceAccounts(namespace).Create(ctx, &sa, metav1.CreateOptions{})
 	if err != nil {
-		return nil, err
+		return nil, requestError(ctx, pluginConfig, err)
 	}
 
 	var secrets []*string
@@ -51,59 +97,336 @@ func (k *KubernetesService) CreateServiceAccount(pluginConfig *PluginConfig, nam
 	}, nil
 }
 
-// GetServiceAccountSecret retrieves the secrets for a newly created service account
-func (k *KubernetesService) GetServiceAccountSecret(pluginConfig *PluginConfig, sa *ServiceAccountDetails) ([]*ServiceAccountSecret, error) {
-	clientSet, err := getClientSet(pluginConfig)
+// GetServiceAccountSecret waits for the token controller to populate the token secret of a newly created service account
+// and returns it, polling with a backoff until the token timeout of the config expires
+func (k *KubernetesService) GetServiceAccountSecret(ctx context.Context, pluginConfig *PluginConfig, sa *ServiceAccountDetails) (*ServiceAccountSecret, error) {
+	clientSet, err := k.getClientSet(pluginConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	ksa, err := clientSet.CoreV1().ServiceAccounts(sa.Namespace).Get(sa.Name, metav1.GetOptions{})
+	timeout := time.Duration(pluginConfig.TokenTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultTokenTimeout
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	interval := tokenPollInitialInterval
+	for {
+		secret, err := findServiceAccountToken(waitCtx, pluginConfig, clientSet, sa)
+		if err == nil && secret != nil {
+			return secret, nil
+		}
+		if err != nil && waitCtx.Err() == nil {
+			return nil, err
+		}
+
+		select {
+		case <-waitCtx.Done():
+			if ctx.Err() != nil {
+				return nil, fmt.Errorf("cancelled waiting for the token of service account '%s' in namespace: %s: %s", sa.Name, sa.Namespace, ctx.Err())
+			}
+			return nil, fmt.Errorf("timed out after %s waiting for Kubernetes to generate the token of service account '%s' in namespace: %s", timeout, sa.Name, sa.Namespace)
+		case <-time.After(interval):
+		}
+
+		interval *= 2
+		if interval > tokenPollMaxInterval {
+			interval = tokenPollMaxInterval
+		}
+	}
+}
+
+// findServiceAccountToken returns the populated token secret of a service account, or nil if the token controller has not
+// generated it yet
+func findServiceAccountToken(ctx context.Context, pluginConfig *PluginConfig, clientSet *kubernetes.Clientset, sa *ServiceAccountDetails) (*ServiceAccountSecret, error) {
+	ctx, cancel := requestContext(ctx, pluginConfig)
+	defer cancel()
 
+	ksa, err := clientSet.CoreV1().ServiceAccounts(sa.Namespace).Get(ctx, sa.Name, metav1.GetOptions{})
 	if err != nil {
-		return nil, err
+		return nil, requestError(ctx, pluginConfig, err)
 	}
 
-	var secrets []*ServiceAccountSecret
 	for _, secret := range ksa.Secrets {
-		secretName := secret.Name
-		token, err := clientSet.CoreV1().Secrets(sa.Namespace).Get(secretName, metav1.GetOptions{})
+		token, err := clientSet.CoreV1().Secrets(sa.Namespace).Get(ctx, secret.Name, metav1.GetOptions{})
+		if err != nil && apierrors.IsNotFound(err) {
+			continue
+		}
 		if err != nil {
-			return nil, err
+			return nil, requestError(ctx, pluginConfig, err)
 		}
 
-		if token != nil {
-			caCert := string(token.Data["ca.crt"])
-			tokenNamespace := string(token.Data["namespace"])
-			tokenValue := string(token.Data["token"])
-			secretValue := ServiceAccountSecret{
-				CACert:    caCert,
-				Namespace: tokenNamespace,
-				Token:     tokenValue,
-			}
-			secrets = append(secrets, &secretValue)
+		// service accounts can reference other secrets, like image pull secrets
+		if token.Type != v1.SecretTypeServiceAccountToken || len(token.Data["token"]) == 0 {
+			continue
 		}
+
+		return &ServiceAccountSecret{
+			CACert:    string(token.Data["ca.crt"]),
+			Namespace: string(token.Data["namespace"]),
+			Token:     string(token.Data["token"]),
+		}, nil
 	}
 
-	return secrets, nil
+	return nil, nil
+}
+
+// CreateServiceAccountToken requests a bound token for a service account using the TokenRequest API
+func (k *KubernetesService) CreateServiceAccountToken(ctx context.Context, pluginConfig *PluginConfig, sa *ServiceAccountDetails, ttl int) (*ServiceAccountSecret, error) {
+	clientSet, err := k.getClientSet(pluginConfig)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := requestContext(ctx, pluginConfig)
+	defer cancel()
+
+	// the token is bound to the service account, so it stops working when the service account is deleted on revocation,
+	// even if the API server enforced a longer expiration than the lease
+	expiration := int64(ttl)
+	if expiration < minTokenExpirationSeconds {
+		expiration = minTokenExpirationSeconds
+	}
+
+	tokenRequest := authv1.TokenRequest{
+		Spec: authv1.TokenRequestSpec{
+			ExpirationSeconds: &expiration,
+		},
+	}
+
+	tr, err := clientSet.CoreV1().ServiceAccounts(sa.Namespace).CreateToken(ctx, sa.Name, &tokenRequest, metav1.CreateOptions{})
+	if err != nil {
+		return nil, requestError(ctx, pluginConfig, err)
+	}
+
+	caCert, err := clusterCACert(pluginConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ServiceAccountSecret{
+		CACert:    caCert,
+		Namespace: sa.Namespace,
+		Token:     tr.Status.Token,
+		ExpiresAt: tr.Status.ExpirationTimestamp.Time,
+	}, nil
+}
+
+// GetServiceAccount retrieves an existing service account
+func (k *KubernetesService) GetServiceAccount(ctx context.Context, pluginConfig *PluginConfig, namespace string, serviceAccountName string) (*ServiceAccountDetails, error) {
+	clientSet, err := k.getClientSet(pluginConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := requestContext(ctx, pluginConfig)
+	defer cancel()
+
+	sa, err := clientSet.CoreV1().ServiceAccounts(namespace).Get(ctx, serviceAccountName, metav1.GetOptions{})
+	if err != nil {
+		return nil, requestError(ctx, pluginConfig, err)
+	}
+
+	return &ServiceAccountDetails{
+		Namespace: sa.Namespace,
+		UID:       fmt.Sprintf("%s", sa.UID),
+		Name:      sa.Name,
+	}, nil
 }
 
 // DeleteServiceAccount removes a services account from the Kubernetes server
-func (k *KubernetesService) DeleteServiceAccount(pluginConfig *PluginConfig, namespace string, serviceAccountName string) error {
-	clientSet, err := getClientSet(pluginConfig)
+func (k *KubernetesService) DeleteServiceAccount(ctx context.Context, pluginConfig *PluginConfig, namespace string, serviceAccountName string) error {
+	clientSet, err := k.getClientSet(pluginConfig)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := requestContext(ctx, pluginConfig)
+	defer cancel()
+
+	err = clientSet.CoreV1().ServiceAccounts(namespace).Delete(ctx, serviceAccountName, metav1.DeleteOptions{})
+	if err != nil {
+		return requestError(ctx, pluginConfig, err)
+	}
+	return nil
+}
+
+// ListServiceAccounts lists the service accounts in all namespaces with a name starting with the prefix and labels matching the selector
+func (k *KubernetesService) ListServiceAccounts(ctx context.Context, pluginConfig *PluginConfig, prefix string, labelSelector string) ([]*ServiceAccountDetails, error) {
+	clientSet, err := k.getClientSet(pluginConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := requestContext(ctx, pluginConfig)
+	defer cancel()
+
+	list, err := clientSet.CoreV1().ServiceAccounts("").List(ctx, metav1.ListOptions{LabelSelector: labelSelector})
+	if err != nil {
+		return nil, requestError(ctx, pluginConfig, err)
+	}
+
+	var serviceAccounts []*ServiceAccountDetails
+	for _, sa := range list.Items {
+		if !strings.HasPrefix(sa.Name, prefix) {
+			continue
+		}
+		serviceAccounts = append(serviceAccounts, &ServiceAccountDetails{
+			Namespace: sa.Namespace,
+			UID:       fmt.Sprintf("%s", sa.UID),
+			Name:      sa.Name,
+			CreatedAt: sa.CreationTimestamp.Time,
+		})
+	}
+	return serviceAccounts, nil
+}
+
+// GetNamespace retrieves an existing namespace
+func (k *KubernetesService) GetNamespace(ctx context.Context, pluginConfig *PluginConfig, namespace string) (*NamespaceDetails, error) {
+	clientSet, err := k.getClientSet(pluginConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := requestContext(ctx, pluginConfig)
+	defer cancel()
+
+	ns, err := clientSet.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	if err != nil {
+		return nil, requestError(ctx, pluginConfig, err)
+	}
+
+	return &NamespaceDetails{
+		UID:    fmt.Sprintf("%s", ns.UID),
+		Name:   ns.Name,
+		Labels: ns.Labels,
+	}, nil
+}
+
+// DeleteSecret removes a secret, used to invalidate legacy service account tokens
+func (k *KubernetesService) DeleteSecret(ctx context.Context, pluginConfig *PluginConfig, namespace string, secretName string) error {
+	clientSet, err := k.getClientSet(pluginConfig)
 	if err != nil {
 		return err
 	}
-	err = clientSet.CoreV1().ServiceAccounts(namespace).Delete(serviceAccountName, nil)
+	ctx, cancel := requestContext(ctx, pluginConfig)
+	defer cancel()
+
+	err = clientSet.CoreV1().Secrets(namespace).Delete(ctx, secretName, metav1.DeleteOptions{})
+	if err != nil {
+		return requestError(ctx, pluginConfig, err)
+	}
+	return nil
+}
+
+// CreateRole creates a new role in a specific namespace with rules in YAML or JSON
+func (k *KubernetesService) CreateRole(ctx context.Context, pluginConfig *PluginConfig, namespace string, roleName string, rules string, metadata *ObjectMetadata) (*RoleDetails, error) {
+	policyRules, err := parsePolicyRules(rules)
+	if err != nil {
+		return nil, err
+	}
+
+	clientSet, err := k.getClientSet(pluginConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	role := rbac.Role{
+		TypeMeta: metav1.TypeMeta{},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        roleName,
+			Namespace:   namespace,
+			Labels:      metadata.Labels,
+			Annotations: metadata.Annotations,
+		},
+		Rules: policyRules,
+	}
+
+	ctx, cancel := requestContext(ctx, pluginConfig)
+	defer cancel()
+
+	r, err := clientSet.RbacV1().Roles(namespace).Create(ctx, &role, metav1.CreateOptions{})
+	if err != nil {
+		return nil, requestError(ctx, pluginConfig, err)
+	}
+	return &RoleDetails{
+		Namespace: r.Namespace,
+		UID:       fmt.Sprintf("%s", r.UID),
+		Name:      r.Name,
+	}, nil
+}
+
+// DeleteRole removes an existing role
+func (k *KubernetesService) DeleteRole(ctx context.Context, pluginConfig *PluginConfig, namespace string, roleName string) error {
+	clientSet, err := k.getClientSet(pluginConfig)
 	if err != nil {
 		return err
 	}
+	ctx, cancel := requestContext(ctx, pluginConfig)
+	defer cancel()
+
+	err = clientSet.RbacV1().Roles(namespace).Delete(ctx, roleName, metav1.DeleteOptions{})
+	if err != nil {
+		return requestError(ctx, pluginConfig, err)
+	}
 	return nil
 }
 
-// CreateRoleBinding creates a new rolebinding for a service account in a specific namespace
-func (k *KubernetesService) CreateRoleBinding(pluginConfig *PluginConfig, namespace string, serviceAccountName string, roleName string) (*RoleBindingDetails, error) {
-	clientSet, err := getClientSet(pluginConfig)
+// ListRoles lists the roles in all namespaces with a name starting with the prefix and labels matching the selector
+func (k *KubernetesService) ListRoles(ctx context.Context, pluginConfig *PluginConfig, prefix string, labelSelector string) ([]*RoleDetails, error) {
+	clientSet, err := k.getClientSet(pluginConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := requestContext(ctx, pluginConfig)
+	defer cancel()
+
+	list, err := clientSet.RbacV1().Roles("").List(ctx, metav1.ListOptions{LabelSelector: labelSelector})
+	if err != nil {
+		return nil, requestError(ctx, pluginConfig, err)
+	}
+
+	var roles []*RoleDetails
+	for _, r := range list.Items {
+		if !strings.HasPrefix(r.Name, prefix) {
+			continue
+		}
+		roles = append(roles, &RoleDetails{
+			Namespace: r.Namespace,
+			UID:       fmt.Sprintf("%s", r.UID),
+			Name:      r.Name,
+			CreatedAt: r.CreationTimestamp.Time,
+		})
+	}
+	return roles, nil
+}
+
+// GetClusterRole retrieves an existing cluster role
+func (k *KubernetesService) GetClusterRole(ctx context.Context, pluginConfig *PluginConfig, clusterRoleName string) (*RoleDetails, error) {
+	clientSet, err := k.getClientSet(pluginConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := requestContext(ctx, pluginConfig)
+	defer cancel()
+
+	clusterRole, err := clientSet.RbacV1().ClusterRoles().Get(ctx, clusterRoleName, metav1.GetOptions{})
+	if err != nil {
+		return nil, requestError(ctx, pluginConfig, err)
+	}
+
+	return &RoleDetails{
+		UID:       fmt.Sprintf("%s", clusterRole.UID),
+		Name:      clusterRole.Name,
+		CreatedAt: clusterRole.CreationTimestamp.Time,
+	}, nil
+}
+
+// CreateRoleBinding creates a new rolebinding in a specific namespace for a service account in its own namespace, binding either a Role or a ClusterRole
+func (k *KubernetesService) CreateRoleBinding(ctx context.Context, pluginConfig *PluginConfig, namespace string, roleBindingName string, serviceAccountNamespace string, serviceAccountName string, roleKind string, roleName string, metadata *ObjectMetadata) (*RoleBindingDetails, error) {
+	clientSet, err := k.getClientSet(pluginConfig)
 	if err != nil {
 		return nil, err
 	}
@@ -111,26 +434,32 @@ func (k *KubernetesService) CreateRoleBinding(pluginConfig *PluginConfig, namesp
 		{
 			Kind:      "ServiceAccount",
 			Name:      serviceAccountName,
-			Namespace: namespace,
+			Namespace: serviceAccountNamespace,
 		},
 	}
 
 	roleBinding := rbac.RoleBinding{
 		TypeMeta: metav1.TypeMeta{},
 		ObjectMeta: metav1.ObjectMeta{
-			GenerateName: roleBindingNamePrefix,
-			Namespace:    namespace,
+			Name:        roleBindingName,
+			Namespace:   namespace,
+			Labels:      metadata.Labels,
+			Annotations: metadata.Annotations,
 		},
 		Subjects: subjects,
 		RoleRef: rbac.RoleRef{
-			Kind: "ClusterRole",
-			Name: roleName,
+			APIGroup: rbac.GroupName,
+			Kind:     roleKind,
+			Name:     roleName,
 		},
 	}
 
-	rb, err := clientSet.RbacV1().RoleBindings(namespace).Create(&roleBinding)
+	ctx, cancel := requestContext(ctx, pluginConfig)
+	defer cancel()
+
+	rb, err := clientSet.RbacV1().RoleBindings(namespace).Create(ctx, &roleBinding, metav1.CreateOptions{})
 	if err != nil {
-		return nil, err
+		return nil, requestError(ctx, pluginConfig, err)
 	}
 	return &RoleBindingDetails{
 		Namespace: rb.Namespace,
@@ -140,23 +469,347 @@ func (k *KubernetesService) CreateRoleBinding(pluginConfig *PluginConfig, namesp
 }
 
 // DeleteRoleBinding removes an existing role binding
-func (k *KubernetesService) DeleteRoleBinding(pluginConfig *PluginConfig, namespace string, roleBindingName string) error {
-	clientSet, err := getClientSet(pluginConfig)
+func (k *KubernetesService) DeleteRoleBinding(ctx context.Context, pluginConfig *PluginConfig, namespace string, roleBindingName string) error {
+	clientSet, err := k.getClientSet(pluginConfig)
 	if err != nil {
 		return err
 	}
-	err = clientSet.RbacV1().RoleBindings(namespace).Delete(roleBindingName, nil)
+	ctx, cancel := requestContext(ctx, pluginConfig)
+	defer cancel()
+
+	err = clientSet.RbacV1().RoleBindings(namespace).Delete(ctx, roleBindingName, metav1.DeleteOptions{})
+	if err != nil {
+		return requestError(ctx, pluginConfig, err)
+	}
+	return nil
+}
+
+// ListRoleBindings lists the role bindings in all namespaces with a name starting with the prefix and labels matching the selector
+func (k *KubernetesService) ListRoleBindings(ctx context.Context, pluginConfig *PluginConfig, prefix string, labelSelector string) ([]*RoleBindingDetails, error) {
+	clientSet, err := k.getClientSet(pluginConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := requestContext(ctx, pluginConfig)
+	defer cancel()
+
+	list, err := clientSet.RbacV1().RoleBindings("").List(ctx, metav1.ListOptions{LabelSelector: labelSelector})
+	if err != nil {
+		return nil, requestError(ctx, pluginConfig, err)
+	}
+
+	var roleBindings []*RoleBindingDetails
+	for _, rb := range list.Items {
+		if !strings.HasPrefix(rb.Name, prefix) {
+			continue
+		}
+		details := &RoleBindingDetails{
+			Namespace: rb.Namespace,
+			UID:       fmt.Sprintf("%s", rb.UID),
+			Name:      rb.Name,
+			CreatedAt: rb.CreationTimestamp.Time,
+			RoleKind:  rb.RoleRef.Kind,
+			RoleName:  rb.RoleRef.Name,
+		}
+		details.ServiceAccountNamespace, details.ServiceAccountName = boundServiceAccount(rb.Subjects)
+		roleBindings = append(roleBindings, details)
+	}
+	return roleBindings, nil
+}
+
+// CreateClusterRoleBinding creates a new cluster role binding for a service account, granting a ClusterRole in all namespaces
+func (k *KubernetesService) CreateClusterRoleBinding(ctx context.Context, pluginConfig *PluginConfig, clusterRoleBindingName string, namespace string, serviceAccountName string, clusterRoleName string, metadata *ObjectMetadata) (*RoleBindingDetails, error) {
+	clientSet, err := k.getClientSet(pluginConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	clusterRoleBinding := rbac.ClusterRoleBinding{
+		TypeMeta: metav1.TypeMeta{},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        clusterRoleBindingName,
+			Labels:      metadata.Labels,
+			Annotations: metadata.Annotations,
+		},
+		Subjects: []rbac.Subject{
+			{
+				Kind:      serviceAccountKind,
+				Name:      serviceAccountName,
+				Namespace: namespace,
+			},
+		},
+		RoleRef: rbac.RoleRef{
+			APIGroup: rbac.GroupName,
+			Kind:     clusterRoleKind,
+			Name:     clusterRoleName,
+		},
+	}
+
+	ctx, cancel := requestContext(ctx, pluginConfig)
+	defer cancel()
+
+	crb, err := clientSet.RbacV1().ClusterRoleBindings().Create(ctx, &clusterRoleBinding, metav1.CreateOptions{})
+	if err != nil {
+		return nil, requestError(ctx, pluginConfig, err)
+	}
+	return &RoleBindingDetails{
+		UID:  fmt.Sprintf("%s", crb.UID),
+		Name: crb.Name,
+	}, nil
+}
+
+// DeleteClusterRoleBinding removes an existing cluster role binding
+func (k *KubernetesService) DeleteClusterRoleBinding(ctx context.Context, pluginConfig *PluginConfig, clusterRoleBindingName string) error {
+	clientSet, err := k.getClientSet(pluginConfig)
 	if err != nil {
 		return err
 	}
+	ctx, cancel := requestContext(ctx, pluginConfig)
+	defer cancel()
+
+	err = clientSet.RbacV1().ClusterRoleBindings().Delete(ctx, clusterRoleBindingName, metav1.DeleteOptions{})
+	if err != nil {
+		return requestError(ctx, pluginConfig, err)
+	}
 	return nil
 }
 
-// getClientSet sets up a new client for accessing the kubernetes API using a bearer token and a CACert
-func getClientSet(pluginConfig *PluginConfig) (*kubernetes.Clientset, error) {
+// ListClusterRoleBindings lists the cluster role bindings with a name starting with the prefix and labels matching the selector
+func (k *KubernetesService) ListClusterRoleBindings(ctx context.Context, pluginConfig *PluginConfig, prefix string, labelSelector string) ([]*RoleBindingDetails, error) {
+	clientSet, err := k.getClientSet(pluginConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := requestContext(ctx, pluginConfig)
+	defer cancel()
+
+	list, err := clientSet.RbacV1().ClusterRoleBindings().List(ctx, metav1.ListOptions{LabelSelector: labelSelector})
+	if err != nil {
+		return nil, requestError(ctx, pluginConfig, err)
+	}
+
+	var clusterRoleBindings []*RoleBindingDetails
+	for _, crb := range list.Items {
+		if !strings.HasPrefix(crb.Name, prefix) {
+			continue
+		}
+		details := &RoleBindingDetails{
+			UID:       fmt.Sprintf("%s", crb.UID),
+			Name:      crb.Name,
+			CreatedAt: crb.CreationTimestamp.Time,
+			RoleKind:  crb.RoleRef.Kind,
+			RoleName:  crb.RoleRef.Name,
+		}
+		details.ServiceAccountNamespace, details.ServiceAccountName = boundServiceAccount(crb.Subjects)
+		clusterRoleBindings = append(clusterRoleBindings, details)
+	}
+	return clusterRoleBindings, nil
+}
+
+// CheckAccess asks the Kubernetes API if the plugin is allowed to perform an action using a SelfSubjectAccessReview, in all
+// namespaces when the namespace is empty
+func (k *KubernetesService) CheckAccess(ctx context.Context, pluginConfig *PluginConfig, namespace string, verb string, group string, resource string, subresource string) (*AccessReviewDetails, error) {
+	clientSet, err := k.getClientSet(pluginConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	review := &authzv1.SelfSubjectAccessReview{
+		Spec: authzv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authzv1.ResourceAttributes{
+				Namespace:   namespace,
+				Verb:        verb,
+				Group:       group,
+				Resource:    resource,
+				Subresource: subresource,
+			},
+		},
+	}
+	ctx, cancel := requestContext(ctx, pluginConfig)
+	defer cancel()
+
+	review, err = clientSet.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, review, metav1.CreateOptions{})
+	if err != nil {
+		return nil, requestError(ctx, pluginConfig, err)
+	}
+
+	return &AccessReviewDetails{
+		Allowed: review.Status.Allowed && !review.Status.Denied,
+		Reason:  review.Status.Reason,
+	}, nil
+}
+
+// boundServiceAccount returns the namespace and name of the first service account in the subjects of a binding
+func boundServiceAccount(subjects []rbac.Subject) (string, string) {
+	for _, subject := range subjects {
+		if subject.Kind == serviceAccountKind {
+			return subject.Namespace, subject.Name
+		}
+	}
+	return "", ""
+}
+
+// parsePolicyRules parses a list of Kubernetes policy rules in YAML or JSON, every rule needs at least one verb and resource
+func parsePolicyRules(rules string) ([]rbac.PolicyRule, error) {
+	var policyRules []rbac.PolicyRule
+	if err := yaml.UnmarshalStrict([]byte(rules), &policyRules); err != nil {
+		return nil, fmt.Errorf("could not parse rules: %s", err)
+	}
+	if len(policyRules) == 0 {
+		return nil, fmt.Errorf("rules need to contain at least one rule")
+	}
+	for i, rule := range policyRules {
+		if len(rule.Verbs) == 0 {
+			return nil, fmt.Errorf("rule %d has no verbs", i+1)
+		}
+		if len(rule.NonResourceURLs) > 0 {
+			return nil, fmt.Errorf("rule %d has nonResourceURLs, which are not supported in a namespaced role", i+1)
+		}
+		if len(rule.Resources) == 0 {
+			return nil, fmt.Errorf("rule %d has no resources", i+1)
+		}
+	}
+	return policyRules, nil
+}
+
+// generateName returns a name with a random suffix, in the same format Kubernetes uses for generated names. The name is
+// generated before the object is created, so it can be recorded in the write-ahead log
+func generateName(prefix string) string {
+	return prefix + utilrand.String(5)
+}
+
+// labelValue makes a value safe to use as a label value, which is limited to 63 alphanumeric characters, '-', '_' or '.',
+// starting and ending with an alphanumeric character
+func labelValue(value string) string {
+	value = strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, value)
+	if len(value) > 63 {
+		value = value[:63]
+	}
+	return strings.Trim(value, "-_.")
+}
+
+// IsNotFound returns true if the error returned by one of the KubernetesService functions means the object does not exist
+func IsNotFound(err error) bool {
+	return apierrors.IsNotFound(err)
+}
+
+// IsAlreadyExists returns true if the error returned by one of the KubernetesService functions means an object with the
+// same name already exists
+func IsAlreadyExists(err error) bool {
+	return apierrors.IsAlreadyExists(err)
+}
+
+// requestContext returns the context for requests to the Kubernetes API, which are cancelled with the context and time out
+// after the request timeout of the config
+func requestContext(ctx context.Context, pluginConfig *PluginConfig) (context.Context, context.CancelFunc) {
+	if pluginConfig.RequestTimeout > 0 {
+		return context.WithTimeout(ctx, time.Duration(pluginConfig.RequestTimeout)*time.Second)
+	}
+	return context.WithCancel(ctx)
+}
+
+// requestError describes the error of a request to the Kubernetes API that timed out or was cancelled, other errors are
+// returned as they are so they can be checked with IsNotFound and IsAlreadyExists
+func requestError(ctx context.Context, pluginConfig *PluginConfig, err error) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("request to the Kubernetes API at %s timed out after %ds: %s", clusterHost(pluginConfig), pluginConfig.RequestTimeout, err)
+	}
+	if ctx.Err() == context.Canceled {
+		return fmt.Errorf("request to the Kubernetes API at %s was cancelled: %s", clusterHost(pluginConfig), err)
+	}
+	return err
+}
+
+// ResetClients removes all cached clients, so new clients are created with the current configuration
+func (k *KubernetesService) ResetClients() {
+	k.clientsLock.Lock()
+	defer k.clientsLock.Unlock()
+	k.clients = nil
+}
+
+// getClientSet returns a client for accessing the kubernetes API using a bearer token and a CACert, reusing the client
+// created earlier for the same connection settings
+func (k *KubernetesService) getClientSet(pluginConfig *PluginConfig) (*kubernetes.Clientset, error) {
+	key := clientCacheKey(pluginConfig)
+
+	k.clientsLock.RLock()
+	clientSet, ok := k.clients[key]
+	k.clientsLock.RUnlock()
+	if ok {
+		return clientSet, nil
+	}
+
+	k.clientsLock.Lock()
+	defer k.clientsLock.Unlock()
+
+	if clientSet, ok := k.clients[key]; ok {
+		return clientSet, nil
+	}
+
+	clientSet, err := newClientSet(pluginConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if k.clients == nil {
+		k.clients = map[string]*kubernetes.Clientset{}
+	}
+	k.clients[key] = clientSet
+	return clientSet, nil
+}
+
+// clientCacheKey returns the key of the cached client for the connection settings in the config, so a changed config
+// never uses a client created for the previous settings
+func clientCacheKey(pluginConfig *PluginConfig) string {
+	return fingerprint(strings.Join([]string{strconv.FormatBool(pluginConfig.UseInClusterConfig), pluginConfig.Host, pluginConfig.CACert, pluginConfig.ServiceAccountJWT, pluginConfig.ClientCert, pluginConfig.ClientKey}, "\x00"))
+}
+
+// clusterHost returns the url of the Kubernetes API, which is the address of the Kubernetes service from the environment
+// of the pod vault runs in when the in cluster config is used without a host
+func clusterHost(pluginConfig *PluginConfig) string {
+	if pluginConfig.UseInClusterConfig && pluginConfig.Host == "" {
+		return "https://" + net.JoinHostPort(os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT"))
+	}
+	return pluginConfig.Host
+}
+
+// clusterCACert returns the CA cert of the Kubernetes API, which is read from the pod vault runs in when the in cluster
+// config is used
+func clusterCACert(pluginConfig *PluginConfig) (string, error) {
+	if !pluginConfig.UseInClusterConfig {
+		return pluginConfig.CACert, nil
+	}
+	caCert, err := ioutil.ReadFile(inClusterCACertFile)
+	if err != nil {
+		return "", fmt.Errorf("could not read the CA cert of the cluster vault runs in: %s", err)
+	}
+	return string(caCert), nil
+}
+
+// newClientSet sets up a new client for accessing the kubernetes API using a bearer token or client certificate and a CACert
+func newClientSet(pluginConfig *PluginConfig) (*kubernetes.Clientset, error) {
+
+	// the in cluster config makes the client read the token from its file, so the token is picked up when the kubelet
+	// rotates it
+	if pluginConfig.UseInClusterConfig {
+		conf, err := rest.InClusterConfig()
+		if err != nil {
+			return nil, fmt.Errorf("%s is set but vault is not running in a Kubernetes pod: %s", keyUseInClusterConfig, err)
+		}
+		return kubernetes.NewForConfig(conf)
+	}
 
 	tlsConfig := rest.TLSClientConfig{
-		CAData: []byte(pluginConfig.CACert),
+		CAData:   []byte(pluginConfig.CACert),
+		CertData: []byte(pluginConfig.ClientCert),
+		KeyData:  []byte(pluginConfig.ClientKey),
 	}
 
 	conf := &rest.Config{
@@ -0,0 +1,83 @@
+package servian
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParsePolicyRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   string
+		count   int
+		wantErr string
+	}{
+		{
+			name: "yaml",
+			rules: `
+- apiGroups: [""]
+  resources: ["pods", "pods/log"]
+  verbs: ["get", "list", "watch"]
+- apiGroups: ["apps"]
+  resources: ["deployments"]
+  verbs: ["get"]
+`,
+			count: 2,
+		},
+		{
+			name:  "json",
+			rules: `[{"apiGroups": [""], "resources": ["configmaps"], "verbs": ["get"]}]`,
+			count: 1,
+		},
+		{
+			name:  "resource names",
+			rules: `[{"apiGroups": [""], "resources": ["secrets"], "resourceNames": ["app"], "verbs": ["get"]}]`,
+			count: 1,
+		},
+		{name: "not a list", rules: `apiGroups: [""]`, wantErr: "could not parse rules"},
+		{name: "unknown field", rules: `[{"apiGroups": [""], "resources": ["pods"], "verbs": ["get"], "namespace": "default"}]`, wantErr: "could not parse rules"},
+		{name: "empty", rules: `[]`, wantErr: "at least one rule"},
+		{name: "no verbs", rules: `[{"apiGroups": [""], "resources": ["pods"]}]`, wantErr: "rule 1 has no verbs"},
+		{name: "no resources", rules: `[{"apiGroups": [""], "resources": ["pods"], "verbs": ["get"]}, {"apiGroups": [""], "verbs": ["get"]}]`, wantErr: "rule 2 has no resources"},
+		{name: "non resource urls", rules: `[{"nonResourceURLs": ["/healthz"], "verbs": ["get"]}]`, wantErr: "nonResourceURLs"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := parsePolicyRules(tt.rules)
+			if tt.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected an error containing '%s'", tt.wantErr)
+				}
+				if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing '%s', got '%s'", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(rules) != tt.count {
+				t.Errorf("expected %d rules, got %d", tt.count, len(rules))
+			}
+		})
+	}
+}
+
+func TestLabelValue(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{value: "auth_token_1234", expected: "auth_token_1234"},
+		{value: "role/with spaces", expected: "role_with_spaces"},
+		{value: "-leading-and-trailing-", expected: "leading-and-trailing"},
+		{value: strings.Repeat("a", 70), expected: strings.Repeat("a", 63)},
+	}
+
+	for _, tt := range tests {
+		if value := labelValue(tt.value); value != tt.expected {
+			t.Errorf("expected label value of '%s' to be '%s', got '%s'", tt.value, tt.expected, value)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package servian
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const leasesPath = "leases/"
+
+// leaseIndexEntry records the Kubernetes objects created for a lease and when the lease expires, so objects that outlive
+// their lease can be found by tidy
+type leaseIndexEntry struct {
+	Cluster                string             `json:"cluster"`
+	Namespace              string             `json:"namespace"`
+	ServiceAccountName     string             `json:"service_account_name"`
+	Bindings               []namespaceBinding `json:"bindings"`
+	ClusterRoleBindingName string             `json:"cluster_role_binding_name"`
+	ExpiresAt              time.Time          `json:"expires_at"`
+}
+
+// leaseIndexKey returns the storage key of the lease index entry for a service account. The key is hashed because the
+// cluster is empty for the cluster in the plugin config
+func leaseIndexKey(cluster string, namespace string, serviceAccountName string) string {
+	return leasesPath + fingerprint(cluster+"/"+namespace+"/"+serviceAccountName)
+}
+
+// putLeaseIndexEntry stores the lease index entry for a service account
+func putLeaseIndexEntry(ctx context.Context, s logical.Storage, entry *leaseIndexEntry) error {
+	storageEntry, err := logical.StorageEntryJSON(leaseIndexKey(entry.Cluster, entry.Namespace, entry.ServiceAccountName), entry)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, storageEntry)
+}
+
+// loadLeaseIndexEntry loads the lease index entry for a service account, returning nil if there is none
+func loadLeaseIndexEntry(ctx context.Context, s logical.Storage, cluster string, namespace string, serviceAccountName string) (*leaseIndexEntry, error) {
+	raw, err := s.Get(ctx, leaseIndexKey(cluster, namespace, serviceAccountName))
+	if err != nil {
+		return nil, err
+	}
+	if raw == nil {
+		return nil, nil
+	}
+	entry := &leaseIndexEntry{}
+	if err := json.Unmarshal(raw.Value, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// countClusterLeases returns how many lease index entries exist for service accounts in the cluster
+func countClusterLeases(ctx context.Context, s logical.Storage, cluster string) (int, error) {
+	keys, err := s.List(ctx, leasesPath)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, key := range keys {
+		raw, err := s.Get(ctx, leasesPath+key)
+		if err != nil {
+			return 0, err
+		}
+		if raw == nil {
+			continue
+		}
+		entry := &leaseIndexEntry{}
+		if err := json.Unmarshal(raw.Value, entry); err != nil {
+			return 0, err
+		}
+		if entry.Cluster == cluster {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// deleteLeaseIndexEntry removes the lease index entry for a service account
+func deleteLeaseIndexEntry(ctx context.Context, s logical.Storage, cluster string, namespace string, serviceAccountName string) error {
+	return s.Delete(ctx, leaseIndexKey(cluster, namespace, serviceAccountName))
+}
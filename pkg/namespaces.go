@@ -0,0 +1,98 @@
+package servian
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// namespaceCacheTTL is how long a namespace fetched to match a namespace selector is used before it is fetched again
+const namespaceCacheTTL = 30 * time.Second
+
+// namespaceMatches checks if a namespace matches a pattern, which uses the glob syntax of path.Match, e.g. 'team-*' or
+// 'kube-?', after the identity parameters in it are replaced with the values of the entity
+func namespaceMatches(pattern string, namespace string, entity *logical.Entity) (bool, error) {
+	rendered, err := renderIdentityTemplate(pattern, entity)
+	if err != nil {
+		return false, err
+	}
+	return path.Match(rendered, namespace)
+}
+
+// checkNamespace returns an error when a namespace can not be used with the allowed and denied patterns, denied patterns
+// take precedence and an empty list of allowed patterns allows all namespaces. A denied pattern that can not be rendered
+// for the entity denies the namespace, an allowed pattern that can not be rendered allows nothing
+func checkNamespace(allowed []string, denied []string, namespace string, entity *logical.Entity) error {
+	for _, pattern := range denied {
+		matched, err := namespaceMatches(pattern, namespace, entity)
+		if err != nil {
+			return fmt.Errorf("namespace '%s' is denied, the denied pattern '%s' can not be used: %s", namespace, pattern, err)
+		}
+		if matched {
+			return fmt.Errorf("namespace '%s' is denied", namespace)
+		}
+	}
+
+	if len(allowed) == 0 {
+		return nil
+	}
+	for _, pattern := range allowed {
+		if matched, err := namespaceMatches(pattern, namespace, entity); err == nil && matched {
+			return nil
+		}
+	}
+	return fmt.Errorf("namespace '%s' is not allowed", namespace)
+}
+
+// validateNamespacePatterns checks that all patterns of a field are valid globs with supported identity parameters
+func validateNamespacePatterns(key string, patterns []string) error {
+	for _, pattern := range patterns {
+		if err := validateIdentityTemplate(pattern); err != nil {
+			return fmt.Errorf("%s contains an invalid pattern '%s': %s", key, pattern, err)
+		}
+		if _, err := path.Match(identityTemplateRegex.ReplaceAllString(pattern, "x"), ""); err != nil {
+			return fmt.Errorf("%s contains an invalid pattern '%s': %s", key, pattern, err)
+		}
+	}
+	return nil
+}
+
+// namespaceSelectorMatches checks if the labels of a namespace match the namespace selector of the role, a namespace that
+// does not exist never matches
+func (b *backend) namespaceSelectorMatches(ctx context.Context, pluginConfig *PluginConfig, role *Role, namespace string) (bool, error) {
+	selector, err := labels.Parse(role.NamespaceSelector)
+	if err != nil {
+		return false, fmt.Errorf("%s of role '%s' is not a valid label selector: %s", keyNamespaceSelector, role.Name, err)
+	}
+
+	namespaceLabels, err := b.namespaceLabels(ctx, pluginConfig, namespace)
+	if err != nil && IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return selector.Matches(labels.Set(namespaceLabels)), nil
+}
+
+// namespaceLabels returns the labels of a namespace, reusing the labels fetched earlier until they are older than the
+// namespace cache ttl. Namespaces that do not exist are not cached, so they can be used as soon as they are created
+func (b *backend) namespaceLabels(ctx context.Context, pluginConfig *PluginConfig, namespace string) (map[string]string, error) {
+	key := clientCacheKey(pluginConfig) + "/" + namespace
+	if cached, ok := b.namespaceCache.get(key); ok {
+		return cached.(map[string]string), nil
+	}
+
+	ns, err := b.kubernetesService.GetNamespace(ctx, pluginConfig, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	b.namespaceCache.put(key, ns.Labels)
+	return ns.Labels, nil
+}
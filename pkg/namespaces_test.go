@@ -0,0 +1,74 @@
+package servian
+
+import (
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestCheckNamespace(t *testing.T) {
+	tests := []struct {
+		name      string
+		allowed   []string
+		denied    []string
+		namespace string
+		entity    *logical.Entity
+		wantErr   bool
+	}{
+		{name: "no patterns allow all namespaces", namespace: "anything"},
+		{name: "allowed by name", allowed: []string{"staging", "production"}, namespace: "production"},
+		{name: "not allowed by name", allowed: []string{"staging", "production"}, namespace: "development", wantErr: true},
+		{name: "allowed by glob", allowed: []string{"team-*"}, namespace: "team-a"},
+		{name: "glob does not cross the prefix", allowed: []string{"team-*"}, namespace: "other-team-a", wantErr: true},
+		{name: "single character", allowed: []string{"kube-?"}, namespace: "kube-a"},
+		{name: "character range", allowed: []string{"env-[a-c]"}, namespace: "env-d", wantErr: true},
+		{name: "denied without allowed patterns", denied: []string{"kube-*"}, namespace: "kube-system", wantErr: true},
+		{name: "denied takes precedence over allowed", allowed: []string{"*"}, denied: []string{"kube-*"}, namespace: "kube-system", wantErr: true},
+		{name: "not denied", allowed: []string{"*"}, denied: []string{"kube-*"}, namespace: "default"},
+		{name: "allowed by identity", allowed: []string{"{{identity.entity.metadata.team}}-*"}, namespace: "payments-dev", entity: testEntity()},
+		{name: "not allowed by identity", allowed: []string{"{{identity.entity.metadata.team}}-*"}, namespace: "billing-dev", entity: testEntity(), wantErr: true},
+		{name: "allowed pattern without a value allows nothing", allowed: []string{"{{identity.entity.metadata.unknown}}*"}, namespace: "payments", entity: testEntity(), wantErr: true},
+		{name: "allowed pattern without an entity allows nothing", allowed: []string{"{{identity.entity.name}}"}, namespace: "alice", wantErr: true},
+		{name: "denied pattern without a value denies", denied: []string{"{{identity.entity.metadata.unknown}}"}, namespace: "payments", entity: testEntity(), wantErr: true},
+		{name: "denied by identity", denied: []string{"{{identity.entity.name}}"}, namespace: "alice", entity: testEntity(), wantErr: true},
+		{name: "identity values are matched literally", allowed: []string{"{{identity.entity.metadata.glob}}"}, namespace: "axbx[c]\\", entity: testEntity(), wantErr: true},
+		{name: "identity value with glob characters", allowed: []string{"{{identity.entity.metadata.glob}}"}, namespace: "a*b?[c]\\", entity: testEntity()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkNamespace(tt.allowed, tt.denied, tt.namespace, tt.entity)
+			if tt.wantErr && err == nil {
+				t.Fatal("expected the namespace to be refused")
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		})
+	}
+}
+
+func TestValidateNamespacePatterns(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		wantErr  bool
+	}{
+		{name: "names and globs", patterns: []string{"default", "team-*", "kube-?", "env-[a-z]"}},
+		{name: "identity parameters", patterns: []string{"{{identity.entity.metadata.team}}-*"}},
+		{name: "invalid glob", patterns: []string{"env-[a-z"}, wantErr: true},
+		{name: "unsupported parameter", patterns: []string{"{{identity.groups.names}}"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateNamespacePatterns(keyAllowedNamespaces, tt.patterns)
+			if tt.wantErr && err == nil {
+				t.Fatal("expected an error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		})
+	}
+}
@@ -3,7 +3,6 @@ package servian
 import (
 	"context"
 	"fmt"
-	"strings"
 
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
@@ -14,69 +13,256 @@ const keyClusterRoleName = "cluster_role_name"
 const keyKubeConfigPath = "kube_config_path"
 const keyTTLSeconds = "ttl"
 const keyNamespace = "namespace"
+const keyNamespaces = "namespaces"
+const keyBindings = "bindings"
+const keyExistingServiceAccount = "existing_service_account"
 const keyServiceAccountToken = "service_account_token"
 const keyServiceAccountName = "service_account_name"
 const keyRoleBindingName = "role_binding_name"
-const keySAType = "type"
+const keyClusterRoleBindingName = "cluster_role_binding_name"
+const keyRole = "role"
 const keyKubeConfig = "kube_config"
 
-func getAllowedSATypes() []string {
-	return []string{"admin", "editor", "viewer"}
-}
+const serviceAccountPath = "service_account/"
+const clusterServiceAccountPath = "cluster_service_account/"
+
+// defaultClusterServiceAccountNamespace is the namespace service accounts with cluster wide access are created in when
+// no namespace is requested
+const defaultClusterServiceAccountNamespace = "default"
 
 func readSecret(b *backend) *framework.Path {
 	return &framework.Path{
-		Pattern: "service_account/" + framework.GenericNameRegex(keyNamespace) + "/" + framework.GenericNameRegex(keySAType),
-		Fields: map[string]*framework.FieldSchema{
-			keySAType: &framework.FieldSchema{
-				Type:        framework.TypeString,
-				Description: fmt.Sprintf("Type of the service account to be created. Accepted types: %s", strings.Join(getAllowedSATypes(), ", ")),
-				Required:    true,
+		Pattern: serviceAccountPath + framework.GenericNameRegex(keyNamespace) + "/" + framework.GenericNameRegex(keyRole),
+		Fields:  readSecretFields(),
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.handleReadForRole,
+				Summary:  "Create new service account credentials",
 			},
-			keyNamespace: &framework.FieldSchema{
-				Type:        framework.TypeString,
-				Description: "The namespace under which the service account should be created",
-				Required:    true,
+		},
+	}
+}
+
+// readClusterSecret requests service accounts in the clusters configured under clusters/. The path is nested under the
+// cluster, as a policy glob like service_account/prod/* would otherwise match all namespaces of a cluster named prod
+func readClusterSecret(b *backend) *framework.Path {
+	fields := readSecretFields()
+	fields[keyCluster] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "Name of the cluster, configured under clusters/, in which the service account should be created",
+		Required:    true,
+	}
+
+	return &framework.Path{
+		Pattern: clustersPath + framework.GenericNameRegex(keyCluster) + "/" + serviceAccountPath + framework.GenericNameRegex(keyNamespace) + "/" + framework.GenericNameRegex(keyRole),
+		Fields:  fields,
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.handleReadForClusterRole,
+				Summary:  "Create new service account credentials in a cluster",
 			},
-			keyTTLSeconds: &framework.FieldSchema{
-				Type:        framework.TypeDurationSecond,
-				Description: "The time to live for the token in seconds. If not set or set to 0, will use system default.",
+		},
+	}
+}
+
+func readClusterWideSecret(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: clusterServiceAccountPath + framework.GenericNameRegex(keyRole),
+		Fields:  readClusterWideSecretFields(),
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.handleReadClusterWide,
+				Summary:  "Create new service account credentials with access to all namespaces",
 			},
 		},
+	}
+}
+
+func readClusterWideClusterSecret(b *backend) *framework.Path {
+	fields := readClusterWideSecretFields()
+	fields[keyCluster] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "Name of the cluster, configured under clusters/, in which the service account should be created",
+		Required:    true,
+	}
+
+	return &framework.Path{
+		Pattern: clustersPath + framework.GenericNameRegex(keyCluster) + "/" + clusterServiceAccountPath + framework.GenericNameRegex(keyRole),
+		Fields:  fields,
 		Operations: map[logical.Operation]framework.OperationHandler{
 			logical.ReadOperation: &framework.PathOperation{
-				Callback: b.handleReadForRole,
-				Summary:  "Create new service account credentials",
+				Callback: b.handleReadClusterWide,
+				Summary:  "Create new service account credentials with access to all namespaces of a cluster",
 			},
 		},
 	}
 }
 
+// readClusterWideSecretFields returns the fields of a request for cluster wide credentials, where the namespace is only
+// where the service account lives and is optional
+func readClusterWideSecretFields() map[string]*framework.FieldSchema {
+	fields := readSecretFields()
+	fields[keyNamespace] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "The namespace under which the service account should be created, it is granted access to all namespaces",
+		Default:     defaultClusterServiceAccountNamespace,
+	}
+	delete(fields, keyNamespaces)
+	return fields
+}
+
+func readSecretFields() map[string]*framework.FieldSchema {
+	return map[string]*framework.FieldSchema{
+		keyRole: &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "Name of the role the service account is created for, either a role configured under roles/ or one of admin, editor and viewer",
+			Required:    true,
+		},
+		keyNamespace: &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "The namespace under which the service account should be created",
+			Required:    true,
+		},
+		keyNamespaces: &framework.FieldSchema{
+			Type:        framework.TypeCommaStringSlice,
+			Description: "Additional namespaces the service account is granted access to with a role binding in each of them, only for roles with allow_additional_namespaces",
+		},
+		keyTTLSeconds: &framework.FieldSchema{
+			Type:        framework.TypeDurationSecond,
+			Description: "The time to live for the token in seconds. If not set or set to 0, will use system default.",
+		},
+	}
+}
+
 func (b *backend) handleReadForRole(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	return b.readForRole(ctx, req, d, "", false)
+}
+
+func (b *backend) handleReadForClusterRole(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	if d == nil {
+		return nil, fmt.Errorf("could not find a cluster to create the service account in")
+	}
+	return b.readForRole(ctx, req, d, d.Get(keyCluster).(string), false)
+}
+
+func (b *backend) handleReadClusterWide(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	if d == nil {
+		return nil, fmt.Errorf("could not find a role name to associate with the service account")
+	}
+	cluster := ""
+	if _, ok := d.Schema[keyCluster]; ok {
+		cluster = d.Get(keyCluster).(string)
+	}
+	return b.readForRole(ctx, req, d, cluster, true)
+}
+
+// readForRole creates a new service account for the role in the path, in the named cluster or the cluster from the plugin config when empty.
+// A cluster wide service account is bound to the ClusterRole of the role in all namespaces instead of only its own namespace
+func (b *backend) readForRole(ctx context.Context, req *logical.Request, d *framework.FieldData, cluster string, clusterWide bool) (*logical.Response, error) {
 	if d != nil {
-		saType := strings.ToLower(d.Get(keySAType).(string))
-		saTypeFound := false
-		for _, allowedType := range getAllowedSATypes() {
-			if saType == allowedType {
-				saTypeFound = true
-				break
+		roleName := d.Get(keyRole).(string)
+		namespace := d.Get(keyNamespace).(string)
+
+		if namespace == "" {
+			return nil, fmt.Errorf("%s can not be empty", keyNamespace)
+		}
+
+		// reload plugin config on every call to prevent stale config
+		pluginConfig, err := loadConfigForCluster(ctx, req.Storage, cluster)
+		if err != nil {
+			return nil, err
+		}
+
+		role, err := resolveRole(ctx, req.Storage, pluginConfig, roleName)
+		if err != nil {
+			return nil, err
+		}
+
+		if clusterWide && !role.ClusterScoped {
+			return nil, fmt.Errorf("Role '%s' is not cluster scoped and can only be requested for a namespace", role.Name)
+		}
+
+		// a cluster wide service account has access to every namespace, including those the config does not allow
+		if clusterWide && (len(pluginConfig.AllowedNamespaces) > 0 || len(pluginConfig.DeniedNamespaces) > 0) {
+			return logical.ErrorResponse("Role '%s' can not be requested cluster wide, the cluster limits the namespaces with %s or %s", role.Name, keyAllowedNamespaces, keyDeniedNamespaces), nil
+		}
+
+		// the service account is bound in its own namespace and any additional namespaces, a cluster wide service account
+		// is bound in all namespaces at once
+		var targetNamespaces []string
+		if !clusterWide {
+			targetNamespaces = []string{namespace}
+			if additional, ok := d.GetOk(keyNamespaces); ok {
+				targetNamespaces = uniqueNamespaces(append(targetNamespaces, additional.([]string)...))
+			}
+
+			// the policy path of the request only limits the namespace in the path, so additional namespaces need to be
+			// allowed by the role
+			if len(targetNamespaces) > 1 && !role.AllowAdditionalNamespaces {
+				return logical.ErrorResponse("Role '%s' can only be requested for the namespace in the path, it does not set %s", role.Name, keyAllowAdditionalNamespaces), nil
 			}
 		}
 
-		if saTypeFound == false {
-			return nil, fmt.Errorf("Service account type '%s' not one of the allowed types: %s", saType, strings.Join(getAllowedSATypes(), ", "))
+		// namespace patterns can contain identity parameters, which are rendered with the entity of the request
+		var entity *logical.Entity
+		if req.EntityID != "" && hasIdentityTemplate(pluginConfig.AllowedNamespaces, pluginConfig.DeniedNamespaces, role.AllowedNamespaces, role.DeniedNamespaces) {
+			entity, err = b.System().EntityInfo(req.EntityID)
+			if err != nil {
+				return nil, err
+			}
 		}
 
-		namespace := d.Get(keyNamespace).(string)
+		// namespaces are checked before anything is created in the cluster
+		for _, target := range append([]string{namespace}, targetNamespaces...) {
+			if err := role.checkNamespace(pluginConfig, target, entity); err != nil {
+				return logical.ErrorResponse(err.Error()), nil
+			}
+		}
 
-		if namespace == "" {
-			return nil, fmt.Errorf("%s can not be empty", keyNamespace)
+		if role.NamespaceSelector != "" {
+			for _, target := range targetNamespaces {
+				matches, err := b.namespaceSelectorMatches(ctx, pluginConfig, role, target)
+				if err != nil {
+					return nil, err
+				}
+				if !matches {
+					return logical.ErrorResponse("Role '%s' can not be used: namespace '%s' does not match the namespace selector '%s'", role.Name, target, role.NamespaceSelector), nil
+				}
+			}
+		}
+
+		// binding a ClusterRole that does not exist succeeds, but the service account would not have any permissions. When the
+		// ClusterRole can not be checked, e.g. because the plugin is not allowed to get cluster roles, the request continues
+		if role.ClusterRole != "" && role.ServiceAccountName == "" {
+			exists, err := b.clusterRoleExists(ctx, pluginConfig, role.ClusterRole)
+			if err != nil {
+				b.Logger().Warn(fmt.Sprintf("Could not check ClusterRole '%s' of role '%s' exists: %s", role.ClusterRole, role.Name, err))
+			} else if !exists {
+				return logical.ErrorResponse("Role '%s' can not be used: ClusterRole '%s' does not exist in the cluster", role.Name, role.ClusterRole), nil
+			}
 		}
 
 		ttl := d.Get(keyTTLSeconds).(int)
-		return b.createSecret(ctx, req.Storage, saType, namespace, ttl)
+		if role.ServiceAccountName != "" {
+			return b.createToken(ctx, req, pluginConfig, cluster, role, namespace, ttl)
+		}
+		return b.createSecret(ctx, req, pluginConfig, cluster, role, namespace, targetNamespaces, ttl, clusterWide)
 	}
 
 	return nil, fmt.Errorf("could not find a role name to associate with the service account")
 
 }
+
+// uniqueNamespaces removes empty and duplicate namespaces, keeping the order of the first occurrence
+func uniqueNamespaces(namespaces []string) []string {
+	seen := map[string]bool{}
+	var unique []string
+	for _, namespace := range namespaces {
+		if namespace == "" || seen[namespace] {
+			continue
+		}
+		seen[namespace] = true
+		unique = append(unique, namespace)
+	}
+	return unique
+}
@@ -0,0 +1,354 @@
+package servian
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const keyName = "name"
+const keyAllowedNamespaces = "allowed_namespaces"
+const keyDeniedNamespaces = "denied_namespaces"
+const keyRules = "rules"
+const keyClusterScoped = "cluster_scoped"
+const keyNamespaceSelector = "namespace_selector"
+const keyAllowAdditionalNamespaces = "allow_additional_namespaces"
+
+const rolesPath = "roles/"
+
+// Role contains the definition of a type of service account that can be requested from the plugin
+type Role struct {
+	Name              string   `json:"name"`
+	ClusterRole       string   `json:"cluster_role_name"`
+	Rules             string   `json:"rules"`
+	ClusterScoped     bool     `json:"cluster_scoped"`
+	AllowedNamespaces []string `json:"allowed_namespaces"`
+	DeniedNamespaces  []string `json:"denied_namespaces"`
+	NamespaceSelector string   `json:"namespace_selector"`
+
+	// AllowAdditionalNamespaces allows the namespaces parameter to bind service accounts in more namespaces than the one
+	// in the path, which the policy path of the request does not limit
+	AllowAdditionalNamespaces bool `json:"allow_additional_namespaces"`
+
+	// ServiceAccountName is the existing service account tokens are issued for, instead of creating a new one
+	ServiceAccountName string `json:"service_account_name"`
+	DefaultTTL         int    `json:"ttl"`
+	MaxTTL             int    `json:"max_ttl"`
+}
+
+func listRoles(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: rolesPath + "?$",
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ListOperation: &framework.PathOperation{
+				Callback: b.handleRoleList,
+				Summary:  "List the configured roles",
+			},
+		},
+	}
+}
+
+func configureRole(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: rolesPath + framework.GenericNameRegex(keyName),
+		Fields: map[string]*framework.FieldSchema{
+			keyName: {
+				Type:        framework.TypeString,
+				Description: "Name of the role, used in the path when requesting a service account",
+				Required:    true,
+			},
+			keyClusterRoleName: {
+				Type:        framework.TypeString,
+				Description: "Name of the Kubernetes ClusterRole that will be bound to service accounts created for this role. Can not be combined with rules.",
+			},
+			keyRules: {
+				Type:        framework.TypeString,
+				Description: "List of Kubernetes policy rules in YAML or JSON. A Role with these rules is created for every service account created for this role. Can not be combined with cluster_role_name.",
+			},
+			keyServiceAccountName: {
+				Type:        framework.TypeString,
+				Description: "Name of an existing service account that tokens are issued for in the requested namespace, instead of creating a new service account. Can not be combined with cluster_role_name, rules or cluster_scoped.",
+			},
+			keyClusterScoped: {
+				Type:        framework.TypeBool,
+				Description: "Allow service accounts to be requested for this role from cluster_service_account/, binding the ClusterRole in all namespaces with a ClusterRoleBinding. Requires cluster_role_name.",
+			},
+			keyAllowedNamespaces: {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "List of namespace patterns service accounts can be created in for this role, e.g. 'team-*'. If not set, all namespaces are allowed. '*' allows all namespaces.",
+			},
+			keyDeniedNamespaces: {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "List of namespace patterns service accounts can never be created in for this role, e.g. 'kube-*'. Takes precedence over allowed_namespaces.",
+			},
+			keyNamespaceSelector: {
+				Type:        framework.TypeString,
+				Description: "Kubernetes label selector the labels of a namespace need to match before service accounts can be created in it for this role, e.g. 'team=payments'.",
+			},
+			keyAllowAdditionalNamespaces: {
+				Type:        framework.TypeBool,
+				Description: "Allow service accounts of this role to be granted access to additional namespaces with the namespaces parameter. Requires allowed_namespaces, which every additional namespace needs to match.",
+			},
+			keyDefaultTTL: {
+				Type:        framework.TypeDurationSecond,
+				Description: "Default time to live for credentials of this role. If not set or set to 0, will use the plugin default.",
+			},
+			keyMaxTTL: {
+				Type:        framework.TypeDurationSecond,
+				Description: "Maximum time to live for credentials of this role. If not set or set to 0, will use the plugin max, which it can not exceed.",
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.CreateOperation: &framework.PathOperation{
+				Callback: b.handleRoleWrite,
+				Summary:  "Create a role",
+			},
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.handleRoleWrite,
+				Summary:  "Update a role",
+			},
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.handleRoleRead,
+				Summary:  "Read a role",
+			},
+			logical.DeleteOperation: &framework.PathOperation{
+				Callback: b.handleRoleDelete,
+				Summary:  "Delete a role",
+			},
+		},
+	}
+}
+
+func (b *backend) handleRoleList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	roles, err := req.Storage.List(ctx, rolesPath)
+	if err != nil {
+		return nil, err
+	}
+	return logical.ListResponse(roles), nil
+}
+
+func (b *backend) handleRoleWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+
+	role := Role{
+		Name:              d.Get(keyName).(string),
+		ClusterRole:       d.Get(keyClusterRoleName).(string),
+		Rules:             d.Get(keyRules).(string),
+		ClusterScoped:     d.Get(keyClusterScoped).(bool),
+		AllowedNamespaces: d.Get(keyAllowedNamespaces).([]string),
+		DeniedNamespaces:  d.Get(keyDeniedNamespaces).([]string),
+		NamespaceSelector: d.Get(keyNamespaceSelector).(string),
+
+		AllowAdditionalNamespaces: d.Get(keyAllowAdditionalNamespaces).(bool),
+
+		ServiceAccountName: d.Get(keyServiceAccountName).(string),
+		DefaultTTL:         d.Get(keyDefaultTTL).(int),
+		MaxTTL:             d.Get(keyMaxTTL).(int),
+	}
+
+	err := role.Validate()
+
+	if err != nil {
+		return logical.ErrorResponse("Role not valid: %s", err), err
+	}
+
+	entry, err := logical.StorageEntryJSON(rolesPath+role.Name, role)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+
+	warnings, err := b.roleClusterRoleWarnings(ctx, req.Storage, &role)
+	if err != nil {
+		return nil, err
+	}
+	if len(warnings) == 0 {
+		return nil, nil
+	}
+	resp := &logical.Response{}
+	for _, warning := range warnings {
+		resp.AddWarning(warning)
+	}
+	return resp, nil
+}
+
+func (b *backend) handleRoleRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	if role, err := loadRole(ctx, req.Storage, d.Get(keyName).(string)); err != nil {
+		return nil, err
+	} else if role == nil {
+		return nil, nil
+	} else {
+
+		resp := &logical.Response{
+			Data: map[string]interface{}{
+				keyName:              role.Name,
+				keyClusterRoleName:   role.ClusterRole,
+				keyRules:             role.Rules,
+				keyClusterScoped:     role.ClusterScoped,
+				keyAllowedNamespaces: role.AllowedNamespaces,
+				keyDeniedNamespaces:  role.DeniedNamespaces,
+				keyNamespaceSelector: role.NamespaceSelector,
+
+				keyAllowAdditionalNamespaces: role.AllowAdditionalNamespaces,
+
+				keyServiceAccountName: role.ServiceAccountName,
+				keyDefaultTTL:         role.DefaultTTL,
+				keyMaxTTL:             role.MaxTTL,
+			},
+		}
+		return resp, nil
+	}
+}
+
+func (b *backend) handleRoleDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	if err := req.Storage.Delete(ctx, rolesPath+d.Get(keyName).(string)); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// loadRole is a helper function to simplify the loading of a role from the logical store
+func loadRole(ctx context.Context, s logical.Storage, name string) (*Role, error) {
+	raw, err := s.Get(ctx, rolesPath+name)
+	if err != nil {
+		return nil, err
+	}
+	if raw == nil {
+		return nil, nil
+	}
+	role := &Role{}
+	if err := json.Unmarshal(raw.Value, role); err != nil {
+		return nil, err
+	}
+	return role, nil
+}
+
+// resolveRole finds the role with the given name in storage, falling back to the admin, editor and viewer roles in the plugin config.
+// The admin, editor and viewer roles are case insensitive, as the service account types they replace were
+func resolveRole(ctx context.Context, s logical.Storage, pluginConfig *PluginConfig, name string) (*Role, error) {
+	role, err := loadRole(ctx, s, name)
+	if err != nil {
+		return nil, err
+	}
+	if role != nil {
+		return role, nil
+	}
+
+	builtin := strings.ToLower(name)
+	if builtin != name && (builtin == "admin" || builtin == "editor" || builtin == "viewer") {
+		role, err := loadRole(ctx, s, builtin)
+		if err != nil {
+			return nil, err
+		}
+		if role != nil {
+			return role, nil
+		}
+	}
+
+	clusterRole := ""
+	switch builtin {
+	case "admin":
+		clusterRole = pluginConfig.AdminRole
+	case "editor":
+		clusterRole = pluginConfig.EditorRole
+	case "viewer":
+		clusterRole = pluginConfig.ViewerRole
+	}
+
+	if clusterRole == "" {
+		return nil, fmt.Errorf("Role '%s' does not exist", name)
+	}
+
+	return &Role{
+		Name:        builtin,
+		ClusterRole: clusterRole,
+	}, nil
+}
+
+// Validate validates the role by checking all required values are correct
+func (r *Role) Validate() error {
+
+	// the permissions of an existing service account are managed in the cluster, nothing is bound to it
+	if r.ServiceAccountName != "" && (r.ClusterRole != "" || r.Rules != "" || r.ClusterScoped) {
+		return fmt.Errorf("%s can not be combined with %s, %s or %s", keyServiceAccountName, keyClusterRoleName, keyRules, keyClusterScoped)
+	}
+
+	if r.ServiceAccountName == "" && r.ClusterRole == "" && r.Rules == "" {
+		return fmt.Errorf("one of %s, %s or %s needs to be set", keyClusterRoleName, keyRules, keyServiceAccountName)
+	}
+
+	if r.ClusterRole != "" && r.Rules != "" {
+		return fmt.Errorf("%s and %s can not both be set", keyClusterRoleName, keyRules)
+	}
+
+	if r.Rules != "" {
+		if _, err := parsePolicyRules(r.Rules); err != nil {
+			return err
+		}
+	}
+
+	// a role is created in a single namespace, so it can not be granted in all namespaces
+	if r.ClusterScoped && r.ClusterRole == "" {
+		return fmt.Errorf("%s requires %s", keyClusterScoped, keyClusterRoleName)
+	}
+
+	if r.DefaultTTL < 0 {
+		return fmt.Errorf("%s can not be negative", keyDefaultTTL)
+	}
+
+	if r.MaxTTL < 0 {
+		return fmt.Errorf("%s can not be negative", keyMaxTTL)
+	}
+
+	if r.MaxTTL > 0 && r.DefaultTTL > r.MaxTTL {
+		return fmt.Errorf("%s can not be larger than %s", keyDefaultTTL, keyMaxTTL)
+	}
+
+	if err := validateNamespacePatterns(keyAllowedNamespaces, r.AllowedNamespaces); err != nil {
+		return err
+	}
+
+	if err := validateNamespacePatterns(keyDeniedNamespaces, r.DeniedNamespaces); err != nil {
+		return err
+	}
+
+	if _, err := labels.Parse(r.NamespaceSelector); err != nil {
+		return fmt.Errorf("%s is not a valid label selector: %s", keyNamespaceSelector, err)
+	}
+
+	// a cluster wide service account has access to every namespace, including those not matching the selector or patterns
+	if r.ClusterScoped && r.NamespaceSelector != "" {
+		return fmt.Errorf("%s can not be combined with %s", keyNamespaceSelector, keyClusterScoped)
+	}
+	if r.ClusterScoped && (len(r.AllowedNamespaces) > 0 || len(r.DeniedNamespaces) > 0) {
+		return fmt.Errorf("%s and %s can not be combined with %s", keyAllowedNamespaces, keyDeniedNamespaces, keyClusterScoped)
+	}
+
+	// the policy path only limits the namespace in the path, additional namespaces are only limited by the role
+	if r.AllowAdditionalNamespaces && len(r.AllowedNamespaces) == 0 {
+		return fmt.Errorf("%s requires %s", keyAllowAdditionalNamespaces, keyAllowedNamespaces)
+	}
+	if r.AllowAdditionalNamespaces && r.ServiceAccountName != "" {
+		return fmt.Errorf("%s can not be combined with %s", keyAllowAdditionalNamespaces, keyServiceAccountName)
+	}
+
+	return nil
+}
+
+// checkNamespace returns an error if service accounts for the role can not be created in the namespace by the entity of
+// the request, either because of the namespaces of the role or those of the cluster
+func (r *Role) checkNamespace(pluginConfig *PluginConfig, namespace string, entity *logical.Entity) error {
+	if err := checkNamespace(pluginConfig.AllowedNamespaces, pluginConfig.DeniedNamespaces, namespace, entity); err != nil {
+		return fmt.Errorf("Role '%s' can not be used: %s by the configuration of the cluster", r.Name, err)
+	}
+	if err := checkNamespace(r.AllowedNamespaces, r.DeniedNamespaces, namespace, entity); err != nil {
+		return fmt.Errorf("Role '%s' can not be used: %s for the role", r.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package servian
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const rotateRootPath = "rotate-root"
+
+// defaultRootTokenTTL is used for configs stored before root_token_ttl existed
+const defaultRootTokenTTL = 768 * 60 * 60
+
+func rotateRoot(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: configPath + "/" + rotateRootPath,
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.handleRotateRoot,
+				Summary:  "Rotate the jwt used by the plugin",
+			},
+		},
+	}
+}
+
+func rotateClusterRoot(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: clustersPath + framework.GenericNameRegex(keyName) + "/" + rotateRootPath,
+		Fields: map[string]*framework.FieldSchema{
+			keyName: {
+				Type:        framework.TypeString,
+				Description: "Name of the cluster",
+				Required:    true,
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.handleRotateRoot,
+				Summary:  "Rotate the jwt used by the plugin for a cluster",
+			},
+		},
+	}
+}
+
+func (b *backend) handleRotateRoot(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	cluster := ""
+	if _, ok := d.Schema[keyName]; ok {
+		cluster = d.Get(keyName).(string)
+	}
+
+	config, err := b.rotateRootToken(ctx, req.Storage, cluster)
+	if err != nil {
+		return logical.ErrorResponse("Could not rotate jwt: %s", err), nil
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			keyJWTFingerprint:   fingerprint(config.ServiceAccountJWT),
+			keyLastRootRotation: config.LastRootRotation.UTC().Format(time.RFC3339),
+		},
+	}
+	if claims, err := parseJWTClaims(config.ServiceAccountJWT); err == nil && claims.ExpiresAt > 0 {
+		resp.Data[keyJWTExpiry] = time.Unix(claims.ExpiresAt, 0).UTC().Format(time.RFC3339)
+	}
+
+	next := config.nextRootRotation()
+	if !next.IsZero() {
+		resp.Data[keyNextRootRotation] = next.UTC().Format(time.RFC3339)
+	}
+	if !config.RootTokenExpiry.IsZero() && !config.rotationPeriodCoversExpiry() {
+		resp.AddWarning(fmt.Sprintf("The new jwt expires at %s, which %s does not cover. It will be rotated automatically at %s, make sure the periodic function of vault runs until then",
+			config.RootTokenExpiry.UTC().Format(time.RFC3339), keyRootRotationPeriod, next.UTC().Format(time.RFC3339)))
+	}
+	return resp, nil
+}
+
+// rotateRootToken requests a new token for the service account the plugin authenticates as, verifies it and replaces the
+// stored jwt with it. Legacy tokens are invalidated by removing their secret, bound tokens can not be revoked and will expire.
+func (b *backend) rotateRootToken(ctx context.Context, s logical.Storage, cluster string) (*PluginConfig, error) {
+	b.rotateLock.Lock()
+	defer b.rotateLock.Unlock()
+
+	config, err := loadConfigForCluster(ctx, s, cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.UseInClusterConfig {
+		return nil, fmt.Errorf("the token of the pod vault runs in is rotated by Kubernetes when %s is set", keyUseInClusterConfig)
+	}
+
+	if config.ServiceAccountJWT == "" {
+		return nil, fmt.Errorf("only a jwt can be rotated, the plugin authenticates with a client certificate")
+	}
+
+	claims, err := parseJWTClaims(config.ServiceAccountJWT)
+	if err != nil {
+		return nil, err
+	}
+
+	namespace, name, err := claims.serviceAccount()
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := config.RootTokenTTL
+	if ttl <= 0 {
+		ttl = defaultRootTokenTTL
+	}
+
+	token, err := b.kubernetesService.CreateServiceAccountToken(ctx, config, &ServiceAccountDetails{Namespace: namespace, Name: name}, ttl)
+	if err != nil {
+		return nil, fmt.Errorf("could not request a new token for service account '%s/%s': %s", namespace, name, err)
+	}
+
+	rotated := *config
+	rotated.ServiceAccountJWT = token.Token
+	rotated.LastRootRotation = time.Now()
+	rotated.RootTokenExpiry = token.ExpiresAt
+
+	// make sure the new token works before the current one is replaced
+	if _, err := b.kubernetesService.GetServiceAccount(ctx, &rotated, namespace, name); err != nil {
+		return nil, fmt.Errorf("could not verify the new token: %s", err)
+	}
+
+	if err := saveConfigForCluster(ctx, s, cluster, &rotated); err != nil {
+		return nil, err
+	}
+	b.kubernetesService.ResetClients()
+
+	b.Logger().Info(fmt.Sprintf("rotated jwt for service account '%s/%s' of cluster '%s'", namespace, name, cluster))
+
+	if claims.SecretName != "" {
+		if err := b.kubernetesService.DeleteSecret(ctx, &rotated, namespace, claims.SecretName); err != nil {
+			b.Logger().Warn(fmt.Sprintf("Could not remove secret '%s' to invalidate the previous jwt: %s", claims.SecretName, err))
+		}
+	}
+
+	return &rotated, nil
+}
+
+// rootRotationExpiryFraction is how much of the lifetime of a rotated jwt can pass before it is rotated again, so it is
+// replaced well before it expires even if rotation fails a few times
+const rootRotationExpiryFraction = 2.0 / 3.0
+
+// nextRootRotation returns when the jwt is due for scheduled rotation, which is after the root rotation period or after
+// two thirds of the lifetime of a rotated jwt, whichever comes first. It is zero when no rotation is scheduled
+func (c *PluginConfig) nextRootRotation() time.Time {
+	var next time.Time
+	if c.RootRotationPeriod > 0 {
+		next = c.LastRootRotation.Add(time.Duration(c.RootRotationPeriod) * time.Second)
+	}
+	if !c.RootTokenExpiry.IsZero() && !c.LastRootRotation.IsZero() {
+		lifetime := c.RootTokenExpiry.Sub(c.LastRootRotation)
+		byExpiry := c.LastRootRotation.Add(time.Duration(float64(lifetime) * rootRotationExpiryFraction))
+		if next.IsZero() || byExpiry.Before(next) {
+			next = byExpiry
+		}
+	}
+	return next
+}
+
+// rotationPeriodCoversExpiry checks if the root rotation period rotates the jwt before two thirds of its lifetime
+func (c *PluginConfig) rotationPeriodCoversExpiry() bool {
+	if c.RootRotationPeriod <= 0 {
+		return false
+	}
+	lifetime := c.RootTokenExpiry.Sub(c.LastRootRotation)
+	return time.Duration(c.RootRotationPeriod)*time.Second <= time.Duration(float64(lifetime)*rootRotationExpiryFraction)
+}
+
+// rotateRootTokens rotates the jwt of the plugin config and every cluster that is due for scheduled rotation
+func (b *backend) rotateRootTokens(ctx context.Context, s logical.Storage) error {
+	configs, err := loadAllClusterConfigs(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	for cluster, config := range configs {
+		next := config.nextRootRotation()
+		if next.IsZero() || time.Now().Before(next) {
+			continue
+		}
+
+		if _, err := b.rotateRootToken(ctx, s, cluster); err != nil {
+			b.Logger().Error(fmt.Sprintf("Error rotating jwt of cluster '%s': %s", cluster, err))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,190 @@
+package servian
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const keySkipVerify = "skip_verify"
+const keySelfCheck = "self_check"
+
+const rbacGroup = "rbac.authorization.k8s.io"
+
+// selfCheckAction is an action the plugin needs to be allowed to perform, in all namespaces when the namespace is empty
+type selfCheckAction struct {
+	verb        string
+	group       string
+	resource    string
+	subresource string
+	namespace   string
+
+	// neededFor describes the feature that needs the action
+	neededFor string
+}
+
+// String returns the action in the format of kubectl auth can-i
+func (a selfCheckAction) String() string {
+	resource := a.resource
+	if a.group != "" {
+		resource += "." + a.group
+	}
+	if a.subresource != "" {
+		resource += "/" + a.subresource
+	}
+	if a.namespace != "" {
+		return a.verb + " " + resource + " -n " + a.namespace
+	}
+	return a.verb + " " + resource
+}
+
+// scope describes the namespaces the action is checked in
+func (a selfCheckAction) scope() string {
+	if a.namespace != "" {
+		return fmt.Sprintf("in namespace %s", a.namespace)
+	}
+	return "in all namespaces"
+}
+
+// selfCheckActions returns the actions needed by the config, which are required to save it, and the actions only needed
+// by features of roles, which are advisory as roles can be written after the config
+func selfCheckActions(pluginConfig *PluginConfig) (required []selfCheckAction, advisory []selfCheckAction) {
+	const credentials = "creating and revoking credentials"
+	required = []selfCheckAction{
+		{verb: "create", resource: "serviceaccounts", neededFor: credentials},
+		{verb: "delete", resource: "serviceaccounts", neededFor: credentials},
+		{verb: "create", group: rbacGroup, resource: "rolebindings", neededFor: credentials},
+		{verb: "delete", group: rbacGroup, resource: "rolebindings", neededFor: credentials},
+	}
+	if pluginConfig.LegacyTokenSecret {
+		required = append(required, selfCheckAction{verb: "get", resource: "secrets", neededFor: keyLegacyTokenSecret})
+	} else {
+		required = append(required, selfCheckAction{verb: "create", resource: "serviceaccounts", subresource: "token", neededFor: credentials})
+	}
+
+	tidyActions := []selfCheckAction{
+		{verb: "list", resource: "serviceaccounts", neededFor: "tidy"},
+		{verb: "list", group: rbacGroup, resource: "roles", neededFor: "tidy"},
+		{verb: "delete", group: rbacGroup, resource: "roles", neededFor: "tidy"},
+		{verb: "list", group: rbacGroup, resource: "rolebindings", neededFor: "tidy"},
+		{verb: "list", group: rbacGroup, resource: "clusterrolebindings", neededFor: "tidy"},
+		{verb: "delete", group: rbacGroup, resource: "clusterrolebindings", neededFor: "tidy"},
+	}
+	if pluginConfig.TidyPeriod > 0 {
+		required = append(required, tidyActions...)
+	} else {
+		advisory = append(advisory, tidyActions...)
+	}
+
+	// the jwt is rotated by requesting a token for the service account of the plugin in its own namespace
+	if claims, err := parseJWTClaims(pluginConfig.ServiceAccountJWT); err == nil && !pluginConfig.UseInClusterConfig {
+		if namespace, name, err := claims.serviceAccount(); err == nil {
+			rotateActions := []selfCheckAction{
+				{verb: "create", resource: "serviceaccounts", subresource: "token", namespace: namespace, neededFor: "rotate-root of " + name},
+				{verb: "get", resource: "serviceaccounts", namespace: namespace, neededFor: "rotate-root of " + name},
+			}
+			if claims.SecretName != "" {
+				rotateActions = append(rotateActions, selfCheckAction{verb: "delete", resource: "secrets", namespace: namespace, neededFor: "rotate-root of " + name})
+			}
+			if pluginConfig.RootRotationPeriod > 0 {
+				required = append(required, rotateActions...)
+			} else {
+				advisory = append(advisory, rotateActions...)
+			}
+		}
+	}
+
+	advisory = append(advisory,
+		selfCheckAction{verb: "get", resource: "serviceaccounts", neededFor: "roles with " + keyServiceAccountName},
+		selfCheckAction{verb: "create", group: rbacGroup, resource: "roles", neededFor: "roles with " + keyRules},
+		selfCheckAction{verb: "delete", group: rbacGroup, resource: "roles", neededFor: "roles with " + keyRules},
+		selfCheckAction{verb: "create", group: rbacGroup, resource: "clusterrolebindings", neededFor: "roles with " + keyClusterScoped},
+		selfCheckAction{verb: "delete", group: rbacGroup, resource: "clusterrolebindings", neededFor: "roles with " + keyClusterScoped},
+		selfCheckAction{verb: "get", resource: "namespaces", neededFor: "roles with " + keyNamespaceSelector},
+		selfCheckAction{verb: "get", group: rbacGroup, resource: "clusterroles", neededFor: "checking the ClusterRoles of roles exist"},
+	)
+	return required, advisory
+}
+
+// selfCheck connects to the Kubernetes API with the config, which verifies the host and CA cert, and checks the plugin is
+// allowed to perform the actions it needs. It returns a report of the checks, a description of every failed required
+// check, and a warning for every failed advisory check
+func (b *backend) selfCheck(ctx context.Context, pluginConfig *PluginConfig) (map[string]interface{}, []string, []string) {
+	report := map[string]interface{}{
+		keyHost:     clusterHost(pluginConfig),
+		"connected": false,
+	}
+
+	var failures, warnings []string
+	permissions := map[string]interface{}{}
+	advisoryPermissions := map[string]interface{}{}
+	required, advisory := selfCheckActions(pluginConfig)
+	checked := map[string]bool{}
+	for i, action := range append(required, advisory...) {
+		isRequired := i < len(required)
+
+		// an action can be needed by more than one feature, it is reported once, preferably as required
+		if checked[action.String()] {
+			continue
+		}
+		checked[action.String()] = true
+
+		review, err := b.kubernetesService.CheckAccess(ctx, pluginConfig, action.namespace, action.verb, action.group, action.resource, action.subresource)
+		if err != nil {
+			// the access reviews only fail when the API can not be reached or the credentials are not accepted
+			report["error"] = err.Error()
+			return report, append(failures, fmt.Sprintf("could not connect to the Kubernetes API at %s: %s", clusterHost(pluginConfig), err)), warnings
+		}
+		report["connected"] = true
+
+		message := fmt.Sprintf("not allowed to %s %s, which is needed for %s", action, action.scope(), action.neededFor)
+		if review.Reason != "" {
+			message += ": " + review.Reason
+		}
+		if isRequired {
+			permissions[action.String()] = review.Allowed
+			if !review.Allowed {
+				failures = append(failures, message)
+			}
+		} else {
+			advisoryPermissions[action.String()] = review.Allowed
+			if !review.Allowed {
+				warnings = append(warnings, "Self check: "+message)
+			}
+		}
+	}
+	report["permissions"] = permissions
+	report["advisory_permissions"] = advisoryPermissions
+	return report, failures, warnings
+}
+
+// verifyConfig runs the self check for a config before it is saved, unless skip_verify is set. A failed self check is
+// returned as a bad request that contains the error and the report, and reported as failed so the config is not saved.
+// Otherwise the response contains the report and warns about failed advisory checks
+func (b *backend) verifyConfig(ctx context.Context, req *logical.Request, pluginConfig *PluginConfig, skipVerify bool) (*logical.Response, bool, error) {
+	if skipVerify {
+		return nil, false, nil
+	}
+
+	report, failures, warnings := b.selfCheck(ctx, pluginConfig)
+	if len(failures) > 0 {
+		// vault only returns the error of an error response, so the report is returned with the status code instead
+		resp, err := logical.RespondWithStatusCode(&logical.Response{
+			Data: map[string]interface{}{
+				"error":      fmt.Sprintf("Self check failed: %s. Set %s=true to save the configuration anyway", strings.Join(failures, "; "), keySkipVerify),
+				keySelfCheck: report,
+			},
+			Warnings: warnings,
+		}, req, http.StatusBadRequest)
+		return resp, true, err
+	}
+	return &logical.Response{
+		Data: map[string]interface{}{
+			keySelfCheck: report,
+		},
+		Warnings: warnings,
+	}, false, nil
+}
@@ -0,0 +1,261 @@
+package servian
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const keyRemoved = "removed"
+const keyKind = "kind"
+
+const tidyPath = "tidy"
+
+// tidyGracePeriod gives revocation a chance to remove the objects of an expired lease before tidy does
+const tidyGracePeriod = 5 * time.Minute
+
+func tidy(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: tidyPath,
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.handleTidy,
+				Summary:  "Remove service accounts, roles and (cluster) role bindings that outlived their lease",
+			},
+		},
+	}
+}
+
+func (b *backend) handleTidy(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	configs, err := loadAllClusterConfigs(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	removed := []map[string]interface{}{}
+	var warnings []string
+	for cluster := range configs {
+		objects, err := b.tidyCluster(ctx, req.Storage, cluster, req.MountAccessor)
+		removed = append(removed, objects...)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("Could not tidy cluster '%s': %s", cluster, err))
+		}
+	}
+
+	if err := b.tidyLeaseIndex(ctx, req.Storage); err != nil {
+		warnings = append(warnings, fmt.Sprintf("Could not tidy lease index: %s", err))
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			keyRemoved: removed,
+		},
+		Warnings: warnings,
+	}, nil
+}
+
+// tidyCluster removes the service accounts, roles, role bindings and cluster role bindings created by this mount in a cluster that outlived their lease,
+// returning the objects that were removed
+func (b *backend) tidyCluster(ctx context.Context, s logical.Storage, cluster string, mountAccessor string) ([]map[string]interface{}, error) {
+	b.tidyLock.Lock()
+	defer b.tidyLock.Unlock()
+
+	pluginConfig, err := loadConfigForCluster(ctx, s, cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	selector, err := mountLabelSelector(mountAccessor)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	expired := func(namespace string, serviceAccountName string, createdAt time.Time) (bool, error) {
+		entry, err := loadLeaseIndexEntry(ctx, s, cluster, namespace, serviceAccountName)
+		if err != nil {
+			return false, err
+		}
+		if entry != nil {
+			return now.After(entry.ExpiresAt.Add(tidyGracePeriod)), nil
+		}
+
+		// objects without a lease index entry were created before the index existed or their entry was lost, either way
+		// no lease can outlive the max ttl of the cluster, or of the mount when the cluster has none
+		maxTTL := time.Duration(getMaxTTL(b.System(), pluginConfig, &Role{})) * time.Second
+		return maxTTL > 0 && now.After(createdAt.Add(maxTTL+tidyGracePeriod)), nil
+	}
+
+	removed := []map[string]interface{}{}
+	removedObject := func(kind string, namespace string, name string) {
+		b.Logger().Info(fmt.Sprintf("tidy removed %s with name: %s in namespace: %s of cluster '%s'", kind, name, namespace, cluster))
+		removed = append(removed, map[string]interface{}{
+			keyCluster:   cluster,
+			keyNamespace: namespace,
+			keyName:      name,
+			keyKind:      kind,
+		})
+	}
+
+	roleBindings, err := b.kubernetesService.ListRoleBindings(ctx, pluginConfig, roleBindingNamePrefix, selector)
+	if err != nil {
+		return removed, err
+	}
+	for _, rb := range roleBindings {
+		if isExpired, err := expired(rb.ServiceAccountNamespace, rb.ServiceAccountName, rb.CreatedAt); err != nil {
+			return removed, err
+		} else if !isExpired {
+			continue
+		}
+
+		err := b.kubernetesService.DeleteRoleBinding(ctx, pluginConfig, rb.Namespace, rb.Name)
+		if err != nil && !IsNotFound(err) {
+			return removed, err
+		}
+		removedObject(roleBindingKind, rb.Namespace, rb.Name)
+	}
+
+	clusterRoleBindings, err := b.kubernetesService.ListClusterRoleBindings(ctx, pluginConfig, clusterRoleBindingNamePrefix, selector)
+	if err != nil {
+		return removed, err
+	}
+	for _, crb := range clusterRoleBindings {
+		if isExpired, err := expired(crb.ServiceAccountNamespace, crb.ServiceAccountName, crb.CreatedAt); err != nil {
+			return removed, err
+		} else if !isExpired {
+			continue
+		}
+
+		err := b.kubernetesService.DeleteClusterRoleBinding(ctx, pluginConfig, crb.Name)
+		if err != nil && !IsNotFound(err) {
+			return removed, err
+		}
+		removedObject(clusterRoleBindingKind, "", crb.Name)
+	}
+
+	// roles created for a lease are only referenced by the role binding of the lease, so a role that is not bound is
+	// left over once its role binding is gone
+	roles, err := b.kubernetesService.ListRoles(ctx, pluginConfig, roleNamePrefix, selector)
+	if err != nil {
+		return removed, err
+	}
+	bound, err := b.kubernetesService.ListRoleBindings(ctx, pluginConfig, roleBindingNamePrefix, selector)
+	if err != nil {
+		return removed, err
+	}
+	boundRoles := map[string]bool{}
+	for _, rb := range bound {
+		if rb.RoleKind == roleKind {
+			boundRoles[rb.Namespace+"/"+rb.RoleName] = true
+		}
+	}
+	for _, r := range roles {
+		if boundRoles[r.Namespace+"/"+r.Name] || now.Before(r.CreatedAt.Add(tidyGracePeriod)) {
+			continue
+		}
+
+		err := b.kubernetesService.DeleteRole(ctx, pluginConfig, r.Namespace, r.Name)
+		if err != nil && !IsNotFound(err) {
+			return removed, err
+		}
+		removedObject(roleKind, r.Namespace, r.Name)
+	}
+
+	serviceAccounts, err := b.kubernetesService.ListServiceAccounts(ctx, pluginConfig, serviceAccountNamePrefix, selector)
+	if err != nil {
+		return removed, err
+	}
+	for _, sa := range serviceAccounts {
+		if isExpired, err := expired(sa.Namespace, sa.Name, sa.CreatedAt); err != nil {
+			return removed, err
+		} else if !isExpired {
+			continue
+		}
+
+		err := b.kubernetesService.DeleteServiceAccount(ctx, pluginConfig, sa.Namespace, sa.Name)
+		if err != nil && !IsNotFound(err) {
+			return removed, err
+		}
+		removedObject(serviceAccountKind, sa.Namespace, sa.Name)
+
+		if err := deleteLeaseIndexEntry(ctx, s, cluster, sa.Namespace, sa.Name); err != nil {
+			return removed, err
+		}
+	}
+
+	return removed, nil
+}
+
+// mountLabelSelector returns the label selector for objects created by the mount with the accessor. Other mounts can use
+// the same cluster and create objects with the same name prefixes, so tidy never touches objects without these labels
+func mountLabelSelector(mountAccessor string) (string, error) {
+	if mountAccessor == "" {
+		return "", fmt.Errorf("the accessor of the mount is unknown, so the objects it created can not be identified")
+	}
+	return labels.SelectorFromSet(labels.Set{
+		labelManagedBy:     managedByValue,
+		labelMountAccessor: labelValue(mountAccessor),
+	}).String(), nil
+}
+
+// tidyLeaseIndex removes lease index entries that expired, which are left behind when the objects of a lease were
+// removed outside of the plugin
+func (b *backend) tidyLeaseIndex(ctx context.Context, s logical.Storage) error {
+	keys, err := s.List(ctx, leasesPath)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, key := range keys {
+		raw, err := s.Get(ctx, leasesPath+key)
+		if err != nil {
+			return err
+		}
+		if raw == nil {
+			continue
+		}
+
+		lease := &leaseIndexEntry{}
+		if err := raw.DecodeJSON(lease); err != nil {
+			return err
+		}
+		if now.After(lease.ExpiresAt.Add(tidyGracePeriod)) {
+			if err := s.Delete(ctx, leasesPath+key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// tidyClusters tidies every cluster that is due for scheduled tidy
+func (b *backend) tidyClusters(ctx context.Context, s logical.Storage, mountAccessor string) error {
+	configs, err := loadAllClusterConfigs(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	tidied := false
+	for cluster, config := range configs {
+		period := time.Duration(config.TidyPeriod) * time.Second
+		if period <= 0 || time.Since(b.lastTidy[cluster]) < period {
+			continue
+		}
+
+		if _, err := b.tidyCluster(ctx, s, cluster, mountAccessor); err != nil {
+			b.Logger().Error(fmt.Sprintf("Error tidying cluster '%s': %s", cluster, err))
+		}
+		b.lastTidy[cluster] = time.Now()
+		tidied = true
+	}
+
+	if tidied {
+		return b.tidyLeaseIndex(ctx, s)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package servian
+
+import (
+	"sync"
+	"time"
+)
+
+// ttlCache keeps values fetched from the Kubernetes API for a short time, so they are not fetched for every request
+type ttlCache struct {
+	ttl     time.Duration
+	lock    sync.Mutex
+	entries map[string]*ttlCacheEntry
+}
+
+// ttlCacheEntry contains a cached value and when it was fetched
+type ttlCacheEntry struct {
+	value     interface{}
+	fetchedAt time.Time
+}
+
+// newTTLCache creates a cache that keeps values for the ttl
+func newTTLCache(ttl time.Duration) *ttlCache {
+	return &ttlCache{
+		ttl:     ttl,
+		entries: map[string]*ttlCacheEntry{},
+	}
+}
+
+// get returns the value cached for the key, unless it is older than the ttl
+func (c *ttlCache) get(key string) (interface{}, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || time.Since(entry.fetchedAt) >= c.ttl {
+		return nil, false
+	}
+	return entry.value, true
+}
+
+// put caches the value for the key
+func (c *ttlCache) put(key string, value interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// expired entries are removed here, so the cache does not keep values that are no longer requested
+	for k, entry := range c.entries {
+		if time.Since(entry.fetchedAt) >= c.ttl {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = &ttlCacheEntry{
+		value:     value,
+		fetchedAt: time.Now(),
+	}
+}
@@ -0,0 +1,152 @@
+package servian
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const walKindCredential = "credential"
+
+// walRollbackMinAge is how long a write-ahead log entry is kept before it is considered orphaned and rolled back,
+// it needs to be longer than it takes to create a credential
+const walRollbackMinAge = 5 * time.Minute
+
+// walCredential records the Kubernetes objects that are about to be created for a credential, so they can be removed if
+// the credential is never returned to the user
+type walCredential struct {
+	Cluster                string             `json:"cluster"`
+	Namespace              string             `json:"namespace"`
+	ServiceAccountName     string             `json:"service_account_name"`
+	Bindings               []namespaceBinding `json:"bindings"`
+	ClusterRoleBindingName string             `json:"cluster_role_binding_name"`
+}
+
+// namespaceBinding records the role binding that grants a service account access to a namespace, and the role created
+// for it when the role of the credential has its own rules
+type namespaceBinding struct {
+	Namespace       string `json:"namespace"`
+	RoleBindingName string `json:"role_binding_name"`
+	RoleName        string `json:"role_name"`
+}
+
+// countClusterWALs returns how many write-ahead log entries exist for credentials in the cluster
+func countClusterWALs(ctx context.Context, s logical.Storage, cluster string) (int, error) {
+	ids, err := framework.ListWAL(ctx, s)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, id := range ids {
+		wal, err := framework.GetWAL(ctx, s, id)
+		if err != nil {
+			return 0, err
+		}
+		if wal == nil || wal.Kind != walKindCredential {
+			continue
+		}
+		raw, err := json.Marshal(wal.Data)
+		if err != nil {
+			return 0, err
+		}
+		entry := walCredential{}
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			return 0, err
+		}
+		if entry.Cluster == cluster {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// walRollback removes the Kubernetes objects recorded in a write-ahead log entry that was never committed
+func (b *backend) walRollback(ctx context.Context, req *logical.Request, kind string, data interface{}) error {
+	if kind != walKindCredential {
+		return fmt.Errorf("unknown write-ahead log entry type '%s'", kind)
+	}
+
+	// the entry is stored as JSON, so it is given to the rollback as a map
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	entry := walCredential{}
+	if err := json.Unmarshal(raw, &entry); err != nil {
+		return err
+	}
+
+	pluginConfig, err := loadConfigForCluster(ctx, req.Storage, entry.Cluster)
+	if err != nil {
+		return err
+	}
+
+	b.Logger().Info(fmt.Sprintf("rolling back service account '%s' and its bindings in namespace: %s", entry.ServiceAccountName, entry.Namespace))
+	return b.rollbackCredential(ctx, pluginConfig, &entry)
+}
+
+// rollbackCredential removes the Kubernetes objects of a partially created credential, objects that were never created
+// are skipped
+func (b *backend) rollbackCredential(ctx context.Context, pluginConfig *PluginConfig, entry *walCredential) error {
+	var err error
+	for _, binding := range entry.Bindings {
+		if binding.RoleBindingName != "" {
+			err = b.kubernetesService.DeleteRoleBinding(ctx, pluginConfig, binding.Namespace, binding.RoleBindingName)
+			if err != nil && !IsNotFound(err) {
+				return err
+			}
+		}
+
+		if binding.RoleName != "" {
+			err = b.kubernetesService.DeleteRole(ctx, pluginConfig, binding.Namespace, binding.RoleName)
+			if err != nil && !IsNotFound(err) {
+				return err
+			}
+		}
+	}
+
+	if entry.ClusterRoleBindingName != "" {
+		err = b.kubernetesService.DeleteClusterRoleBinding(ctx, pluginConfig, entry.ClusterRoleBindingName)
+		if err != nil && !IsNotFound(err) {
+			return err
+		}
+	}
+
+	if entry.ServiceAccountName != "" {
+		err = b.kubernetesService.DeleteServiceAccount(ctx, pluginConfig, entry.Namespace, entry.ServiceAccountName)
+		if err != nil && !IsNotFound(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// cleanupCredential removes the Kubernetes objects a request created for a credential that could not be created, leaving
+// the write-ahead log entry in place for the periodic rollback if the objects could not be removed
+func (b *backend) cleanupCredential(ctx context.Context, s logical.Storage, pluginConfig *PluginConfig, walID string, created *walCredential) {
+	if err := b.rollbackCredential(ctx, pluginConfig, created); err != nil {
+		b.Logger().Warn(fmt.Sprintf("Could not clean up service account '%s', it will be rolled back later: %s", created.ServiceAccountName, err))
+
+		// the rollback must not remove objects with generated names this request did not get to create
+		if err := replaceWAL(ctx, s, &walID, created); err != nil {
+			b.Logger().Warn(fmt.Sprintf("Could not update write-ahead log entry for service account '%s': %s", created.ServiceAccountName, err))
+		}
+		return
+	}
+
+	if created.ServiceAccountName != "" {
+		if err := deleteLeaseIndexEntry(ctx, s, created.Cluster, created.Namespace, created.ServiceAccountName); err != nil {
+			b.Logger().Warn(fmt.Sprintf("Could not remove lease index entry for service account '%s': %s", created.ServiceAccountName, err))
+		}
+	}
+
+	if err := framework.DeleteWAL(ctx, s, walID); err != nil {
+		b.Logger().Warn(fmt.Sprintf("Could not remove write-ahead log entry for service account '%s': %s", created.ServiceAccountName, err))
+	}
+}